@@ -0,0 +1,91 @@
+package apiclient
+
+import (
+	"fmt"
+	"net/http"
+	"peertubeupload/auth"
+	"peertubeupload/logger"
+	"peertubeupload/model"
+	"sync"
+)
+
+// Client sends PeerTube API requests with the current access token. When the
+// instance answers 401, it gets a new token through the Authenticator and
+// sends the request once more, so uploads that outlive a token don't fail
+// halfway.
+type Client struct {
+	HTTP        *http.Client
+	Auth        auth.Authenticator
+	LoginClient *model.Login
+	// BaseURL ends with /api/v1
+	BaseURL  string
+	Username string
+	Password string
+
+	mutex sync.Mutex
+}
+
+func New(httpClient *http.Client, authenticator auth.Authenticator, loginClient *model.Login, baseURL string, username string, password string) *Client {
+	return &Client{
+		HTTP:        httpClient,
+		Auth:        authenticator,
+		LoginClient: loginClient,
+		BaseURL:     baseURL,
+		Username:    username,
+		Password:    password,
+	}
+}
+
+// Token returns the current access token.
+func (c *Client) Token() string {
+	return c.Auth.GetAccessToken()
+}
+
+// EnsureToken logs in, or refreshes the token when it expired.
+func (c *Client) EnsureToken() error {
+	return c.Auth.UpdateTokenIfNeeded(c.BaseURL, c.HTTP, c.LoginClient, "password", c.Username, c.Password)
+}
+
+// Do sends the request built by newRequest with c.HTTP. See DoWith.
+func (c *Client) Do(newRequest func() (*http.Request, error)) (*http.Response, error) {
+	return c.DoWith(c.HTTP, newRequest)
+}
+
+// DoWith sends the request built by newRequest with httpClient, adding the
+// Authorization header. newRequest is called again when the request has to
+// be sent a second time, so it must return a fresh body each time.
+func (c *Client) DoWith(httpClient *http.Client, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	token := c.Token()
+	res, err := c.send(httpClient, newRequest, token)
+	if err != nil || res.StatusCode != http.StatusUnauthorized {
+		return res, err
+	}
+	res.Body.Close()
+
+	if err := c.reauthenticate(token); err != nil {
+		return nil, fmt.Errorf("instance answered 401 and re-authentication failed: %w", err)
+	}
+	return c.send(httpClient, newRequest, c.Token())
+}
+
+func (c *Client) send(httpClient *http.Client, newRequest func() (*http.Request, error), token string) (*http.Response, error) {
+	req, err := newRequest()
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return httpClient.Do(req)
+}
+
+// reauthenticate replaces staleToken, unless another request already did
+// while this one waited for the lock.
+func (c *Client) reauthenticate(staleToken string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.Token() != staleToken {
+		return nil
+	}
+	logger.LogInfo("Access token rejected, authenticating again", nil)
+	return c.Auth.Reauthenticate(c.BaseURL, c.HTTP, c.LoginClient, c.Username, c.Password)
+}
@@ -0,0 +1,131 @@
+package apiclient
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"peertubeupload/model"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeAuth hands out token and counts the re-logins, each of which gives a
+// fresh token.
+type fakeAuth struct {
+	mutex   sync.Mutex
+	token   string
+	relogin int
+}
+
+func (a *fakeAuth) LoginPrerequisite(baseURL string, client *http.Client) (*model.Login, error) {
+	return nil, nil
+}
+
+func (a *fakeAuth) Login(baseURL string, client *http.Client, loginClient *model.Login, grant_type string, username string, password string) error {
+	return nil
+}
+
+func (a *fakeAuth) UpdateTokenIfNeeded(baseURL string, client *http.Client, loginClient *model.Login, grant_type string, username string, password string) error {
+	return nil
+}
+
+func (a *fakeAuth) RefreshAccessToken(baseURL string, client *http.Client, loginClient *model.Login, refreshToken string) error {
+	return nil
+}
+
+func (a *fakeAuth) Reauthenticate(baseURL string, client *http.Client, loginClient *model.Login, username string, password string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.relogin++
+	a.token = "fresh"
+	return nil
+}
+
+func (a *fakeAuth) GetAccessToken() string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.token
+}
+
+func TestDoWithReplaysAfter401(t *testing.T) {
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if r.Header.Get("Authorization") != "Bearer fresh" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	auth := &fakeAuth{token: "expired"}
+	client := New(server.Client(), auth, nil, server.URL+"/api/v1", "alice", "secret")
+
+	res, err := client.Do(func() (*http.Request, error) {
+		return http.NewRequest("PUT", server.URL+"/api/v1/videos/1", strings.NewReader("payload"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		t.Errorf("status = %d, want the replay's 204", res.StatusCode)
+	}
+	if auth.relogin != 1 {
+		t.Errorf("re-logged in %d times, want 1", auth.relogin)
+	}
+	if len(bodies) != 2 || bodies[1] != "payload" {
+		t.Errorf("server got bodies %q, want the payload sent again", bodies)
+	}
+}
+
+func TestDoWithReauthenticatesOnceForConcurrent401s(t *testing.T) {
+	const requests = 5
+	// the rejected requests are held until all of them arrived, so every one
+	// of them sees a 401 for the same token
+	var arrived sync.WaitGroup
+	arrived.Add(requests)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer fresh" {
+			arrived.Done()
+			arrived.Wait()
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	auth := &fakeAuth{token: "expired"}
+	client := New(server.Client(), auth, nil, server.URL+"/api/v1", "alice", "secret")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := client.Do(func() (*http.Request, error) {
+				return http.NewRequest("GET", server.URL+"/api/v1/users/me", nil)
+			})
+			if err != nil {
+				errs <- err
+				return
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				errs <- fmt.Errorf("status = %d, want 200", res.StatusCode)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if auth.relogin != 1 {
+		t.Errorf("re-logged in %d times, want 1", auth.relogin)
+	}
+}
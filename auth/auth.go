@@ -10,5 +10,6 @@ type Authenticator interface {
 	Login(baseURL string, client *http.Client, loginClient *model.Login, grant_type string, username string, password string) error
 	UpdateTokenIfNeeded(baseURL string, client *http.Client, loginClient *model.Login, grant_type string, username string, password string) error
 	RefreshAccessToken(baseURL string, client *http.Client, loginClient *model.Login, refreshToken string) error
+	Reauthenticate(baseURL string, client *http.Client, loginClient *model.Login, username string, password string) error
 	GetAccessToken() string
 }
@@ -2,6 +2,7 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
 	"peertubeupload/logger"
@@ -18,18 +19,39 @@ type Config struct {
 		CommentsEnabled bool   `json:"commentsEnabled"`
 		Privacy         int    `json:"privacy"`
 		WaitTranscoding bool   `json:"waitTranscoding"`
+		TokenFile       string `json:"tokenFile"`
+		OTPSecret       string `json:"otpSecret"`
+		OTPPrompt       bool   `json:"otpPrompt"`
 	} `json:"apiConfig"`
 	LoadType struct {
-		LoadPathFromDB     bool     `json:"loadPathFromDB"`
-		LoadFromFolder     bool     `json:"loadFromFolder"`
-		SpecificExtensions bool     `json:"specificextensions"`
-		Extensions         []string `json:"extensions"`
-		ConvertAudioToMp3  bool     `json:"convertAudioToMp3"`
-		TempFolder         string   `json:"tempFolder"`
-		LogType            string   `json:"logType"`
+		LoadPathFromDB      bool     `json:"loadPathFromDB"`
+		LoadFromFolder      bool     `json:"loadFromFolder"`
+		SpecificExtensions  bool     `json:"specificextensions"`
+		Extensions          []string `json:"extensions"`
+		ConvertAudioToMp3   bool     `json:"convertAudioToMp3"`
+		TempFolder          string   `json:"tempFolder"`
+		LogType             string   `json:"logType"`
+		StateFile           string   `json:"stateFile"`
+		SkipUploaded        bool     `json:"skipUploaded"`
+		MatchByHash         bool     `json:"matchByHash"`
+		VerifyRemote        bool     `json:"verifyRemote"`
+		DateSources         []string `json:"dateSources"`
+		FilenameDatePattern string   `json:"filenameDatePattern"`
+		FilenameDateLayout  string   `json:"filenameDateLayout"`
+		ReplaceChanged      bool     `json:"replaceChanged"`
 	} `json:"loadType"`
 	FolderConfig struct {
-		Path string `json:"path"`
+		Path         string   `json:"path"`
+		Description  string   `json:"description"`
+		Tags         []string `json:"tags"`
+		Category     int      `json:"category"`
+		Licence      int      `json:"licence"`
+		Language     string   `json:"language"`
+		NSFW         bool     `json:"nsfw"`
+		Support      string   `json:"support"`
+		Watch        bool     `json:"watch"`
+		PollInterval int      `json:"pollInterval"`
+		StableFor    int      `json:"stableFor"`
 	} `json:"folderConfig"`
 	DBConfig struct {
 		DBType           string   `json:"dbType"`
@@ -44,10 +66,77 @@ type Config struct {
 		Description      string   `json:"description"`
 		FilePath         string   `json:"file_path"`
 		ReferenceColumns []string `json:"reference_columns"`
+		Tags             string   `json:"tags"`
+		Category         string   `json:"category"`
+		Licence          string   `json:"licence"`
+		Language         string   `json:"language"`
+		NSFW             string   `json:"nsfw"`
+		Support          string   `json:"support"`
+		Privacy          string   `json:"privacy"`
+		Captions         string   `json:"captions"`
+		Thumbnail        string   `json:"thumbnail"`
+		CreateDate       string   `json:"create_date"`
+		Destinations     string   `json:"destinations"`
+		Channel          string   `json:"channel"`
+		Playlist         string   `json:"playlist"`
+		PlaylistPosition string   `json:"playlistPosition"`
 	} `json:"dbConfig"`
 	ProccessConfig struct {
-		Threads int `json:"threads"`
+		Threads          int  `json:"threads"`
+		ChunkSizeMB      int  `json:"chunkSizeMB"`
+		DrainTimeout     *int `json:"drainTimeout"`
+		CancelOnShutdown bool `json:"cancelOnShutdown"`
 	}
+	CaptionConfig struct {
+		Enabled         bool   `json:"enabled"`
+		DefaultLanguage string `json:"defaultLanguage"`
+		ConvertSrtToVtt bool   `json:"convertSrtToVtt"`
+		ExtractEmbedded bool   `json:"extractEmbedded"`
+	} `json:"captionConfig"`
+	ThumbnailConfig struct {
+		Enabled           bool    `json:"enabled"`
+		GenerateFrame     bool    `json:"generateFrame"`
+		FrameOffset       float64 `json:"frameOffset"`
+		FramePercent      float64 `json:"framePercent"`
+		DefaultAudioImage string  `json:"defaultAudioImage"`
+	} `json:"thumbnailConfig"`
+	DispositionConfig struct {
+		OnSuccess    string `json:"onSuccess"`
+		OnFailure    string `json:"onFailure"`
+		DoneFolder   string `json:"doneFolder"`
+		FailedFolder string `json:"failedFolder"`
+		SourceRoot   string `json:"sourceRoot"`
+	} `json:"dispositionConfig"`
+	ImportConfig struct {
+		PollInterval int  `json:"pollInterval"`
+		Timeout      *int `json:"timeout"`
+	} `json:"importConfig"`
+	VerificationConfig struct {
+		Enabled      bool `json:"enabled"`
+		PollInterval int  `json:"pollInterval"`
+		Timeout      *int `json:"timeout"`
+		DeleteFailed bool `json:"deleteFailed"`
+	} `json:"verificationConfig"`
+	RetryConfig struct {
+		Attempts  int `json:"attempts"`
+		BaseDelay int `json:"baseDelay"`
+		MaxDelay  int `json:"maxDelay"`
+	} `json:"retryConfig"`
+	ChannelConfig struct {
+		FromSubfolder bool          `json:"fromSubfolder"`
+		Rules         []ChannelRule `json:"rules"`
+		Create        bool          `json:"create"`
+		Description   string        `json:"description"`
+	} `json:"channelConfig"`
+	PlaylistConfig struct {
+		FromParentFolder bool   `json:"fromParentFolder"`
+		Create           bool   `json:"create"`
+		Privacy          int    `json:"privacy"`
+		Order            string `json:"order"`
+		EpisodePattern   string `json:"episodePattern"`
+	} `json:"playlistConfig"`
+	// Destinations replaces apiConfig when set, see UploadDestinations.
+	Destinations []Destination `json:"destinations"`
 }
 
 func (c *Config) LoadConfiguration(file string) {
@@ -66,6 +155,9 @@ func (c *Config) LoadConfiguration(file string) {
 				CommentsEnabled bool   `json:"commentsEnabled"`
 				Privacy         int    `json:"privacy"`
 				WaitTranscoding bool   `json:"waitTranscoding"`
+				TokenFile       string `json:"tokenFile"`
+				OTPSecret       string `json:"otpSecret"`
+				OTPPrompt       bool   `json:"otpPrompt"`
 			}{
 				URL:             "http://peertube.localhost",
 				Port:            "9000",
@@ -76,23 +168,42 @@ func (c *Config) LoadConfiguration(file string) {
 				CommentsEnabled: false,
 				Privacy:         2,
 				WaitTranscoding: true,
+				TokenFile:       "./tokens.json",
+				OTPSecret:       "",
+				OTPPrompt:       false,
 			},
 			LoadType: struct {
-				LoadPathFromDB     bool     `json:"loadPathFromDB"`
-				LoadFromFolder     bool     `json:"loadFromFolder"`
-				SpecificExtensions bool     `json:"specificextensions"`
-				Extensions         []string `json:"extensions"`
-				ConvertAudioToMp3  bool     `json:"convertAudioToMp3"`
-				TempFolder         string   `json:"tempFolder"`
-				LogType            string   `json:"logType"`
+				LoadPathFromDB      bool     `json:"loadPathFromDB"`
+				LoadFromFolder      bool     `json:"loadFromFolder"`
+				SpecificExtensions  bool     `json:"specificextensions"`
+				Extensions          []string `json:"extensions"`
+				ConvertAudioToMp3   bool     `json:"convertAudioToMp3"`
+				TempFolder          string   `json:"tempFolder"`
+				LogType             string   `json:"logType"`
+				StateFile           string   `json:"stateFile"`
+				SkipUploaded        bool     `json:"skipUploaded"`
+				MatchByHash         bool     `json:"matchByHash"`
+				VerifyRemote        bool     `json:"verifyRemote"`
+				DateSources         []string `json:"dateSources"`
+				FilenameDatePattern string   `json:"filenameDatePattern"`
+				FilenameDateLayout  string   `json:"filenameDateLayout"`
+				ReplaceChanged      bool     `json:"replaceChanged"`
 			}{
-				LoadPathFromDB:     false,
-				LoadFromFolder:     true,
-				SpecificExtensions: true,
-				Extensions:         []string{".mp4", ".wmv"},
-				ConvertAudioToMp3:  true,
-				TempFolder:         "./tmp/",
-				LogType:            "db , file or none",
+				LoadPathFromDB:      false,
+				LoadFromFolder:      true,
+				SpecificExtensions:  true,
+				Extensions:          []string{".mp4", ".wmv"},
+				ConvertAudioToMp3:   true,
+				TempFolder:          "./tmp/",
+				LogType:             "db , file or none",
+				StateFile:           "./tmp/upload_state.json",
+				SkipUploaded:        false,
+				MatchByHash:         false,
+				VerifyRemote:        false,
+				DateSources:         []string{"db", "sidecar", "container", "quicktime", "filename", "mtime"},
+				FilenameDatePattern: `(\d{4}-\d{2}-\d{2})`,
+				FilenameDateLayout:  "2006-01-02",
+				ReplaceChanged:      false,
 			},
 			DBConfig: struct {
 				DBType           string   `json:"dbType"`
@@ -107,6 +218,20 @@ func (c *Config) LoadConfiguration(file string) {
 				Description      string   `json:"description"`
 				FilePath         string   `json:"file_path"`
 				ReferenceColumns []string `json:"reference_columns"`
+				Tags             string   `json:"tags"`
+				Category         string   `json:"category"`
+				Licence          string   `json:"licence"`
+				Language         string   `json:"language"`
+				NSFW             string   `json:"nsfw"`
+				Support          string   `json:"support"`
+				Privacy          string   `json:"privacy"`
+				Captions         string   `json:"captions"`
+				Thumbnail        string   `json:"thumbnail"`
+				CreateDate       string   `json:"create_date"`
+				Destinations     string   `json:"destinations"`
+				Channel          string   `json:"channel"`
+				Playlist         string   `json:"playlist"`
+				PlaylistPosition string   `json:"playlistPosition"`
 			}{
 				DBType:           "postgres or oracle",
 				Username:         "user",
@@ -120,17 +245,146 @@ func (c *Config) LoadConfiguration(file string) {
 				Description:      "description_column",
 				FilePath:         "file_path_column",
 				ReferenceColumns: []string{"peertube_id", "uuid", "shortuuid", "file_path"},
+				Tags:             "",
+				Category:         "",
+				Licence:          "",
+				Language:         "",
+				NSFW:             "",
+				Support:          "",
+				Privacy:          "",
+				Captions:         "",
+				Thumbnail:        "",
+				CreateDate:       "",
+				Destinations:     "",
+				Channel:          "",
+				Playlist:         "",
+				PlaylistPosition: "",
 			},
 			FolderConfig: struct {
-				Path string `json:"path"`
+				Path         string   `json:"path"`
+				Description  string   `json:"description"`
+				Tags         []string `json:"tags"`
+				Category     int      `json:"category"`
+				Licence      int      `json:"licence"`
+				Language     string   `json:"language"`
+				NSFW         bool     `json:"nsfw"`
+				Support      string   `json:"support"`
+				Watch        bool     `json:"watch"`
+				PollInterval int      `json:"pollInterval"`
+				StableFor    int      `json:"stableFor"`
 			}{
-				Path: "./videos/",
+				Path:         "./videos/",
+				Description:  "",
+				Tags:         []string{},
+				Category:     0,
+				Licence:      0,
+				Language:     "",
+				NSFW:         false,
+				Support:      "",
+				Watch:        false,
+				PollInterval: 30,
+				StableFor:    60,
 			},
 			ProccessConfig: struct {
-				Threads int `json:"threads"`
+				Threads          int  `json:"threads"`
+				ChunkSizeMB      int  `json:"chunkSizeMB"`
+				DrainTimeout     *int `json:"drainTimeout"`
+				CancelOnShutdown bool `json:"cancelOnShutdown"`
 			}{
-				Threads: 1,
+				Threads:          1,
+				ChunkSizeMB:      500,
+				DrainTimeout:     intPtr(60),
+				CancelOnShutdown: false,
 			},
+			CaptionConfig: struct {
+				Enabled         bool   `json:"enabled"`
+				DefaultLanguage string `json:"defaultLanguage"`
+				ConvertSrtToVtt bool   `json:"convertSrtToVtt"`
+				ExtractEmbedded bool   `json:"extractEmbedded"`
+			}{
+				Enabled:         true,
+				DefaultLanguage: "en",
+				ConvertSrtToVtt: true,
+				ExtractEmbedded: false,
+			},
+			ThumbnailConfig: struct {
+				Enabled           bool    `json:"enabled"`
+				GenerateFrame     bool    `json:"generateFrame"`
+				FrameOffset       float64 `json:"frameOffset"`
+				FramePercent      float64 `json:"framePercent"`
+				DefaultAudioImage string  `json:"defaultAudioImage"`
+			}{
+				Enabled:           true,
+				GenerateFrame:     false,
+				FrameOffset:       10,
+				FramePercent:      0,
+				DefaultAudioImage: "",
+			},
+			DispositionConfig: struct {
+				OnSuccess    string `json:"onSuccess"`
+				OnFailure    string `json:"onFailure"`
+				DoneFolder   string `json:"doneFolder"`
+				FailedFolder string `json:"failedFolder"`
+				SourceRoot   string `json:"sourceRoot"`
+			}{
+				OnSuccess:    "keep, move, rename or delete",
+				OnFailure:    "keep or move",
+				DoneFolder:   "./done/",
+				FailedFolder: "./failed/",
+				SourceRoot:   "",
+			},
+			ImportConfig: struct {
+				PollInterval int  `json:"pollInterval"`
+				Timeout      *int `json:"timeout"`
+			}{
+				PollInterval: 15,
+				Timeout:      intPtr(120),
+			},
+			VerificationConfig: struct {
+				Enabled      bool `json:"enabled"`
+				PollInterval int  `json:"pollInterval"`
+				Timeout      *int `json:"timeout"`
+				DeleteFailed bool `json:"deleteFailed"`
+			}{
+				Enabled:      false,
+				PollInterval: 30,
+				Timeout:      intPtr(60),
+				DeleteFailed: false,
+			},
+			RetryConfig: struct {
+				Attempts  int `json:"attempts"`
+				BaseDelay int `json:"baseDelay"`
+				MaxDelay  int `json:"maxDelay"`
+			}{
+				Attempts:  5,
+				BaseDelay: 2,
+				MaxDelay:  120,
+			},
+			ChannelConfig: struct {
+				FromSubfolder bool          `json:"fromSubfolder"`
+				Rules         []ChannelRule `json:"rules"`
+				Create        bool          `json:"create"`
+				Description   string        `json:"description"`
+			}{
+				FromSubfolder: false,
+				Rules:         []ChannelRule{},
+				Create:        false,
+				Description:   "",
+			},
+			PlaylistConfig: struct {
+				FromParentFolder bool   `json:"fromParentFolder"`
+				Create           bool   `json:"create"`
+				Privacy          int    `json:"privacy"`
+				Order            string `json:"order"`
+				EpisodePattern   string `json:"episodePattern"`
+			}{
+				FromParentFolder: false,
+				Create:           false,
+				Privacy:          1,
+				Order:            "none, episode or position",
+				EpisodePattern:   "",
+			},
+			Destinations: []Destination{},
 		}
 		configJSON, _ := json.MarshalIndent(*c, "", " ")
 		_ = os.WriteFile(file, configJSON, 0644)
@@ -170,3 +424,18 @@ func (c *Config) LoadConfiguration(file string) {
 
 	}
 }
+
+// intPtr is used in the sample configuration for the settings whose zero value
+// means something other than unset.
+func intPtr(v int) *int {
+	return &v
+}
+
+// CheckLoadType reports loadType options that can't work together, so the
+// run stops before doing anything instead of silently ignoring one of them.
+func (c *Config) CheckLoadType() error {
+	if c.LoadType.ReplaceChanged && (!c.LoadType.SkipUploaded || !c.LoadType.MatchByHash) {
+		return fmt.Errorf("loadType.replaceChanged needs skipUploaded and matchByHash, the logged hash is how a changed file is found")
+	}
+	return nil
+}
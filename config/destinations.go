@@ -0,0 +1,73 @@
+package config
+
+import "fmt"
+
+// Destination is one PeerTube instance and account media is uploaded to.
+type Destination struct {
+	Name            string `json:"name"`
+	URL             string `json:"url"`
+	Port            string `json:"port"`
+	Username        string `json:"username"`
+	Password        string `json:"password"`
+	ChannelID       int    `json:"channelId"`
+	DownloadEnabled bool   `json:"downloadEnabled"`
+	CommentsEnabled bool   `json:"commentsEnabled"`
+	Privacy         int    `json:"privacy"`
+	WaitTranscoding bool   `json:"waitTranscoding"`
+	TokenFile       string `json:"tokenFile"`
+	OTPSecret       string `json:"otpSecret"`
+	OTPPrompt       bool   `json:"otpPrompt"`
+	// Threads caps the uploads running at once to this destination, 0 leaves
+	// it to processConfig.threads.
+	Threads int `json:"threads"`
+	// UploadsPerHour spaces out the start of uploads, 0 for no limit.
+	UploadsPerHour int `json:"uploadsPerHour"`
+}
+
+// DefaultDestination is the name of the destination built from apiConfig.
+const DefaultDestination = "default"
+
+// UploadDestinations returns the configured destinations, or a single one
+// built from apiConfig when there are none, so older config files keep
+// working unchanged.
+func (c *Config) UploadDestinations() ([]Destination, error) {
+	if len(c.Destinations) == 0 {
+		return []Destination{{
+			Name:            DefaultDestination,
+			URL:             c.APIConfig.URL,
+			Port:            c.APIConfig.Port,
+			Username:        c.APIConfig.Username,
+			Password:        c.APIConfig.Password,
+			ChannelID:       c.APIConfig.ChannelID,
+			DownloadEnabled: c.APIConfig.DownloadEnabled,
+			CommentsEnabled: c.APIConfig.CommentsEnabled,
+			Privacy:         c.APIConfig.Privacy,
+			WaitTranscoding: c.APIConfig.WaitTranscoding,
+			TokenFile:       c.APIConfig.TokenFile,
+			OTPSecret:       c.APIConfig.OTPSecret,
+			OTPPrompt:       c.APIConfig.OTPPrompt,
+		}}, nil
+	}
+
+	seen := map[string]bool{}
+	for _, d := range c.Destinations {
+		if d.Name == "" {
+			return nil, fmt.Errorf("every destination needs a name, it is how the upload log tells them apart")
+		}
+		if seen[d.Name] {
+			return nil, fmt.Errorf("destination name %q is used twice", d.Name)
+		}
+		seen[d.Name] = true
+	}
+	return c.Destinations, nil
+}
+
+// BaseURL is the API root of the destination.
+func (d Destination) BaseURL() string {
+	return fmt.Sprintf("%s:%s/api/v1", d.URL, d.Port)
+}
+
+// Hostname is the instance address without the API path.
+func (d Destination) Hostname() string {
+	return fmt.Sprintf("%s:%s", d.URL, d.Port)
+}
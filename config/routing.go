@@ -0,0 +1,8 @@
+package config
+
+// ChannelRule sends files whose path matches Pattern, a regular expression,
+// to Channel. Channel may use the groups of the match, like $1.
+type ChannelRule struct {
+	Pattern string `json:"pattern"`
+	Channel string `json:"channel"`
+}
@@ -6,67 +6,37 @@ import (
 	"os"
 	"peertubeupload/config"
 	"peertubeupload/logger"
+	"peertubeupload/medialog"
 
 	_ "github.com/godror/godror"
 	_ "github.com/lib/pq"
 )
 
+// InitDB opens the database and creates or completes the log table.
 func InitDB(c *config.Config) (*sql.DB, error) {
-	var connStr string
-	var db *sql.DB
-	var err error
 	var combinedColumns []string
 	if c.LoadType.LoadPathFromDB {
-		combinedColumns = append(c.DBConfig.MediaIdentifier, c.DBConfig.ReferenceColumns...)
+		combinedColumns = append(append([]string{}, c.DBConfig.MediaIdentifier...), medialog.ReferenceColumns(c)...)
 
 	} else {
-		combinedColumns = c.DBConfig.ReferenceColumns
+		combinedColumns = medialog.ReferenceColumns(c)
 	}
 
-	var logTableName string
-	if c.LoadType.LoadPathFromDB {
-		logTableName = fmt.Sprintf("%s_to_peertube_log", c.DBConfig.TableName)
-	} else {
-		logTableName = "peertube_log"
+	db, err := OpenDB(c)
+	if err != nil {
+		return nil, err
 	}
+
+	logTableName := medialog.LogTableName(c)
 	switch c.DBConfig.DBType {
 	case "postgres":
-		connStr = fmt.Sprintf("user=%s password=%s dbname=%s host=%s port=%s sslmode=disable", c.DBConfig.Username, c.DBConfig.Password, c.DBConfig.Dbname, c.DBConfig.Host, c.DBConfig.Port)
-		db, err = sql.Open("postgres", connStr)
-		if err != nil {
-			return nil, err
-		}
-		err = db.Ping()
-		if err != nil {
-			return nil, err
-		}
-
 		err = checkAndCreateOrModifyPostgres(db, logTableName, combinedColumns...)
-
-		if err != nil {
-			logger.LogError("Failed to check and create/modify table and columns", map[string]interface{}{"error": err})
-			os.Exit(1)
-		}
-
 	case "oracle":
-
-		connStr := fmt.Sprintf("%s/%s@%s:%s/%s", c.DBConfig.Username, c.DBConfig.Password, c.DBConfig.Host, c.DBConfig.Port, c.DBConfig.Dbname)
-		db, err = sql.Open("godror", connStr)
-		if err != nil {
-			return nil, err
-		}
-		err = db.Ping()
-		if err != nil {
-			return nil, err
-		}
-
 		err = checkAndCreateOrModifyOracle(db, logTableName, combinedColumns...)
-
-		if err != nil {
-			logger.LogError("Failed to check and create/modify table and columns", map[string]interface{}{"error": err})
-			os.Exit(1)
-		}
-
+	}
+	if err != nil {
+		logger.LogError("Failed to check and create/modify table and columns", map[string]interface{}{"error": err})
+		os.Exit(1)
 	}
 
 	logger.LogInfo("Table and columns are checked and created/modified successfully!", nil)
@@ -74,6 +44,31 @@ func InitDB(c *config.Config) (*sql.DB, error) {
 	return db, nil
 }
 
+// OpenDB connects to the database without touching its schema, for the modes
+// that only read it.
+func OpenDB(c *config.Config) (*sql.DB, error) {
+	var db *sql.DB
+	var err error
+	switch c.DBConfig.DBType {
+	case "postgres":
+		connStr := fmt.Sprintf("user=%s password=%s dbname=%s host=%s port=%s sslmode=disable", c.DBConfig.Username, c.DBConfig.Password, c.DBConfig.Dbname, c.DBConfig.Host, c.DBConfig.Port)
+		db, err = sql.Open("postgres", connStr)
+	case "oracle":
+		connStr := fmt.Sprintf("%s/%s@%s:%s/%s", c.DBConfig.Username, c.DBConfig.Password, c.DBConfig.Host, c.DBConfig.Port, c.DBConfig.Dbname)
+		db, err = sql.Open("godror", connStr)
+	default:
+		return nil, fmt.Errorf("unknown dbType %q, use postgres or oracle", c.DBConfig.DBType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
 // Function to check and create/modify table and columns for PostgreSQL
 func checkAndCreateOrModifyPostgres(db *sql.DB, tableName string, columns ...string) error {
 	// Check if the table exists
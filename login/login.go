@@ -6,18 +6,33 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"os"
+	"peertubeupload/logger"
 	"peertubeupload/model"
 	"sync"
 	"time"
 )
 
-var expirationTime time.Time
+// expiryMargin is how long before it expires a token is replaced, so a
+// request sent just before the expiry doesn't reach the server too late.
+const expiryMargin = time.Minute
 
 // var AccessToken model.AccessToken
 
 type LoginManager struct {
 	AccessToken model.AccessToken
-	mutex       sync.Mutex
+	// TokenFile keeps the tokens between runs, empty to log in every run.
+	TokenFile string
+	// OTPSecret is the base32 TOTP secret of an account with two-factor
+	// authentication, PromptOTP asks for the code on the terminal instead.
+	OTPSecret string
+	PromptOTP bool
+	mutex     sync.Mutex
+
+	username         string
+	expiresAt        time.Time
+	refreshExpiresAt time.Time
+	loaded           bool
 }
 
 func (lm *LoginManager) LoginPrerequisite(baseURL string, client *http.Client) (*model.Login, error) {
@@ -51,9 +66,16 @@ func (lm *LoginManager) LoginPrerequisite(baseURL string, client *http.Client) (
 }
 
 func (lm *LoginManager) Login(baseURL string, client *http.Client, loginClient *model.Login, grant_type string, username string, password string) error {
+	return lm.login(baseURL, client, loginClient, grant_type, username, password, true)
+}
+
+// login logs in with the password. canPrompt tells whether the code of a
+// two-factor account may be asked for at the terminal, which only the
+// login at the start of the run does: later ones hold the mutex every
+// request of the destination waits for.
+func (lm *LoginManager) login(baseURL string, client *http.Client, loginClient *model.Login, grant_type string, username string, password string, canPrompt bool) error {
 
 	apiurl := baseURL + "/users/token"
-	method := "POST"
 	data := url.Values{
 		"client_id":     {loginClient.ClientID},
 		"client_secret": {loginClient.ClientSecret},
@@ -63,23 +85,40 @@ func (lm *LoginManager) Login(baseURL string, client *http.Client, loginClient *
 		"password":      {password},
 	}
 
-	req, err := http.NewRequest(method, apiurl, bytes.NewBufferString(data.Encode()))
-
-	if err != nil {
-		return err
+	otp := ""
+	if lm.OTPSecret != "" {
+		var err error
+		otp, err = TOTP(lm.OTPSecret, time.Now())
+		if err != nil {
+			return err
+		}
 	}
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
-	res, err := client.Do(req)
+	res, body, err := requestToken(client, apiurl, data, otp)
 	if err != nil {
 		return err
 	}
-
-	defer res.Body.Close()
-
-	body, err := io.ReadAll(res.Body)
-	if err != nil {
-		return err
+	if otpRequired(res) {
+		if otp != "" {
+			return fmt.Errorf("the instance rejected the one-time password, check apiConfig.otpSecret and the system clock")
+		}
+		if !lm.PromptOTP {
+			return ErrOTPRequired
+		}
+		if !canPrompt || !isTerminal(os.Stdin) {
+			return ErrOTPPromptUnavailable
+		}
+		otp, err = promptOTP(username)
+		if err != nil {
+			return err
+		}
+		res, body, err = requestToken(client, apiurl, data, otp)
+		if err != nil {
+			return err
+		}
+		if otpRequired(res) {
+			return fmt.Errorf("the instance rejected the one-time password")
+		}
 	}
 
 	accessToken, err := model.UnmarshalAccessToken(body)
@@ -90,40 +129,82 @@ func (lm *LoginManager) Login(baseURL string, client *http.Client, loginClient *
 		return fmt.Errorf("not authorized")
 	}
 
-	lm.AccessToken = model.AccessToken{
-		AccessToken:           accessToken.AccessToken,
-		RefreshToken:          accessToken.RefreshToken,
-		TokenType:             accessToken.TokenType,
-		ExpiresIn:             accessToken.ExpiresIn,
-		RefreshTokenExpiresIn: accessToken.RefreshTokenExpiresIn,
-	}
+	lm.setToken(baseURL, username, accessToken)
 	return nil
 
 }
 
+// requestToken posts the login form, with the x-peertube-otp header when otp
+// is set.
+func requestToken(client *http.Client, apiurl string, data url.Values, otp string) (*http.Response, []byte, error) {
+	req, err := http.NewRequest("POST", apiurl, bytes.NewBufferString(data.Encode()))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	if otp != "" {
+		req.Header.Add("x-peertube-otp", otp)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return res, body, nil
+}
+
+// UpdateTokenIfNeeded gets a new token when the current one expires within
+// expiryMargin: through the refresh token while it is valid, otherwise with
+// a full login. Tokens saved in TokenFile by an earlier run are used first.
 func (lm *LoginManager) UpdateTokenIfNeeded(baseURL string, client *http.Client, loginClient *model.Login, grant_type string, username string, password string) error {
 	lm.mutex.Lock()
 	defer lm.mutex.Unlock()
-	// Check if the current time is after the token expiration time
-	if time.Now().After(expirationTime) {
-		// Get a new token
-		var err error
-		if lm.AccessToken.RefreshToken == "" {
-			// If we don't have a refresh token, do a full login
-			err = lm.Login(baseURL, client, loginClient, grant_type, username, password)
-		} else {
-			// If we have a refresh token, use it to get a new access token
-			err = lm.RefreshAccessToken(baseURL, client, loginClient, lm.AccessToken.RefreshToken)
-		}
-		if err != nil {
-			return err
+
+	// the first call is the login at the start of the run
+	initial := !lm.loaded
+	if !lm.loaded {
+		lm.loaded = true
+		lm.loadToken(baseURL, username)
+	}
+
+	deadline := time.Now().Add(expiryMargin)
+	if deadline.Before(lm.expiresAt) {
+		return nil
+	}
+	if lm.AccessToken.RefreshToken != "" && (lm.refreshExpiresAt.IsZero() || deadline.Before(lm.refreshExpiresAt)) {
+		err := lm.RefreshAccessToken(baseURL, client, loginClient, lm.AccessToken.RefreshToken)
+		if err == nil {
+			return nil
 		}
+		logger.LogWarning("not able to refresh access token, logging in again", map[string]interface{}{"error": err})
+	}
+	return lm.login(baseURL, client, loginClient, grant_type, username, password, initial)
+}
+
+// Reauthenticate gets a new token after the instance rejected the current
+// one, through the refresh token if it is still accepted, otherwise with a
+// password login. It happens mid-run, so a two-factor code is never prompted
+// for.
+func (lm *LoginManager) Reauthenticate(baseURL string, client *http.Client, loginClient *model.Login, username string, password string) error {
+	lm.mutex.Lock()
+	defer lm.mutex.Unlock()
 
-		// Set the new expiration time
-		expirationTime = time.Now().Add(time.Second * time.Duration(lm.AccessToken.ExpiresIn))
+	if lm.AccessToken.RefreshToken != "" && (lm.refreshExpiresAt.IsZero() || time.Now().Before(lm.refreshExpiresAt)) {
+		err := lm.RefreshAccessToken(baseURL, client, loginClient, lm.AccessToken.RefreshToken)
+		if err == nil {
+			return nil
+		}
+		logger.LogWarning("not able to refresh access token, logging in again", map[string]interface{}{"error": err})
 	}
-	return nil
+	return lm.login(baseURL, client, loginClient, "password", username, password, false)
 }
+
 func (lm *LoginManager) RefreshAccessToken(baseURL string, client *http.Client, loginClient *model.Login, refreshToken string) error {
 	apiurl := baseURL + "/users/token"
 	method := "POST"
@@ -152,18 +233,16 @@ func (lm *LoginManager) RefreshAccessToken(baseURL string, client *http.Client,
 		return err
 	}
 
+	if res.StatusCode != 200 {
+		return fmt.Errorf("refresh token rejected: %s", res.Status)
+	}
+
 	accessToken, err := model.UnmarshalAccessToken(body)
 	if err != nil {
 		return err
 	}
 
-	lm.AccessToken = model.AccessToken{
-		AccessToken:           accessToken.AccessToken,
-		RefreshToken:          accessToken.RefreshToken,
-		TokenType:             accessToken.TokenType,
-		ExpiresIn:             accessToken.ExpiresIn,
-		RefreshTokenExpiresIn: accessToken.RefreshTokenExpiresIn,
-	}
+	lm.setToken(baseURL, lm.username, accessToken)
 
 	return nil
 }
@@ -0,0 +1,69 @@
+package login
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"peertubeupload/model"
+	"testing"
+	"time"
+)
+
+// otpServer issues a token only for the one-time password of secret.
+func otpServer(t *testing.T, secret string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/users/token" {
+			http.NotFound(w, r)
+			return
+		}
+		// the previous step too, in case the test crossed a step boundary
+		current, _ := TOTP(secret, time.Now())
+		previous, _ := TOTP(secret, time.Now().Add(-30*time.Second))
+		if otp := r.Header.Get("x-peertube-otp"); otp != current && otp != previous {
+			w.Header().Set("x-peertube-otp", "required; app")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"access_token":"granted","refresh_token":"","expires_in":3600}`)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestLoginWithOTPSecret(t *testing.T) {
+	const secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	server := otpServer(t, secret)
+
+	lm := &LoginManager{OTPSecret: secret}
+	if err := lm.UpdateTokenIfNeeded(server.URL+"/api/v1", server.Client(), &model.Login{}, "password", "alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if got := lm.GetAccessToken(); got != "granted" {
+		t.Errorf("access token = %q, want granted", got)
+	}
+
+	lm = &LoginManager{}
+	err := lm.UpdateTokenIfNeeded(server.URL+"/api/v1", server.Client(), &model.Login{}, "password", "alice", "secret")
+	if !errors.Is(err, ErrOTPRequired) {
+		t.Errorf("login without otpSecret or otpPrompt = %v, want ErrOTPRequired", err)
+	}
+}
+
+func TestReauthenticateNeverPromptsForOTP(t *testing.T) {
+	server := otpServer(t, "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ")
+
+	lm := &LoginManager{PromptOTP: true}
+	err := lm.Reauthenticate(server.URL+"/api/v1", server.Client(), &model.Login{}, "alice", "secret")
+	if !errors.Is(err, ErrOTPPromptUnavailable) {
+		t.Errorf("Reauthenticate = %v, want ErrOTPPromptUnavailable", err)
+	}
+
+	// neither does a login after the first one of the run
+	lm = &LoginManager{PromptOTP: true}
+	lm.loaded = true
+	err = lm.UpdateTokenIfNeeded(server.URL+"/api/v1", server.Client(), &model.Login{}, "password", "alice", "secret")
+	if !errors.Is(err, ErrOTPPromptUnavailable) {
+		t.Errorf("UpdateTokenIfNeeded mid-run = %v, want ErrOTPPromptUnavailable", err)
+	}
+}
@@ -0,0 +1,115 @@
+package login
+
+import (
+	"encoding/json"
+	"os"
+	"peertubeupload/logger"
+	"peertubeupload/model"
+	"sync"
+	"time"
+)
+
+// savedToken is a token as kept in the token file, with the times it expires
+// at rather than the lifetimes the server sent.
+type savedToken struct {
+	Token            model.AccessToken `json:"token"`
+	ExpiresAt        time.Time         `json:"expiresAt"`
+	RefreshExpiresAt time.Time         `json:"refreshExpiresAt"`
+}
+
+// tokenFileMutex serializes writes of managers sharing a token file.
+var tokenFileMutex sync.Mutex
+
+// tokenKey tells apart the tokens of different instances and accounts kept
+// in one file.
+func tokenKey(baseURL string, username string) string {
+	return username + "@" + baseURL
+}
+
+// setToken stores a token the server just issued, works out when it and its
+// refresh token expire and saves them to TokenFile. Callers hold the mutex.
+func (lm *LoginManager) setToken(baseURL string, username string, token model.AccessToken) {
+	now := time.Now()
+	lm.AccessToken = token
+	lm.username = username
+	lm.expiresAt = now.Add(time.Duration(token.ExpiresIn) * time.Second)
+	// without a lifetime the refresh token is simply tried when needed
+	lm.refreshExpiresAt = time.Time{}
+	if token.RefreshTokenExpiresIn > 0 {
+		lm.refreshExpiresAt = now.Add(time.Duration(token.RefreshTokenExpiresIn) * time.Second)
+	}
+
+	if lm.TokenFile == "" {
+		return
+	}
+	tokenFileMutex.Lock()
+	defer tokenFileMutex.Unlock()
+
+	tokens := readTokenFile(lm.TokenFile)
+	tokens[tokenKey(baseURL, username)] = savedToken{Token: token, ExpiresAt: lm.expiresAt, RefreshExpiresAt: lm.refreshExpiresAt}
+	if err := writeTokenFile(lm.TokenFile, tokens); err != nil {
+		logger.LogWarning("not able to save tokens, the next run will log in again", map[string]interface{}{"error": err, "file": lm.TokenFile})
+	}
+}
+
+// loadToken picks up the token an earlier run saved for this instance and
+// account. Callers hold the mutex.
+func (lm *LoginManager) loadToken(baseURL string, username string) {
+	if lm.TokenFile == "" {
+		return
+	}
+	tokenFileMutex.Lock()
+	defer tokenFileMutex.Unlock()
+
+	saved, ok := readTokenFile(lm.TokenFile)[tokenKey(baseURL, username)]
+	if !ok {
+		return
+	}
+	lm.AccessToken = saved.Token
+	lm.username = username
+	lm.expiresAt = saved.ExpiresAt
+	lm.refreshExpiresAt = saved.RefreshExpiresAt
+}
+
+func readTokenFile(path string) map[string]savedToken {
+	tokens := map[string]savedToken{}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.LogWarning("not able to read token file", map[string]interface{}{"error": err, "file": path})
+		}
+		return tokens
+	}
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		logger.LogWarning("token file is not valid, ignoring it", map[string]interface{}{"error": err, "file": path})
+		return map[string]savedToken{}
+	}
+	return tokens
+}
+
+// writeTokenFile replaces the token file atomically. It holds credentials, so
+// it is only readable by its owner.
+func writeTokenFile(path string, tokens map[string]savedToken) error {
+	data, err := json.MarshalIndent(tokens, "", " ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	// an existing file keeps its mode through OpenFile
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
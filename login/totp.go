@@ -0,0 +1,71 @@
+package login
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrOTPRequired is returned by Login when the account has two-factor
+// authentication and neither an OTP secret nor the prompt is configured.
+var ErrOTPRequired = errors.New("the account has two-factor authentication enabled, set apiConfig.otpSecret or enable apiConfig.otpPrompt")
+
+// ErrOTPPromptUnavailable is returned when the account needs a one-time
+// password and otpPrompt is on, but nobody can answer the prompt: stdin isn't
+// a terminal, or the login happens mid-run, when the prompt would hold up
+// every upload of the destination.
+var ErrOTPPromptUnavailable = errors.New("the account needs a two-factor code and it can only be typed in at the terminal when the run starts, set apiConfig.otpSecret to log in again unattended")
+
+// otpRequired reports whether the instance refused the login because it
+// needs a one-time password, it then answers 401 with x-peertube-otp set to
+// "required; app".
+func otpRequired(res *http.Response) bool {
+	return res.StatusCode == http.StatusUnauthorized && strings.HasPrefix(res.Header.Get("x-peertube-otp"), "required")
+}
+
+// TOTP returns the RFC 6238 code for secret at t, with the parameters
+// PeerTube and authenticator apps use: SHA-1, 30 second steps, 6 digits.
+func TOTP(secret string, t time.Time) (string, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(secret), " ", ""))
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+	if err != nil {
+		return "", fmt.Errorf("otpSecret is not valid base32: %w", err)
+	}
+
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(t.Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	// dynamic truncation, RFC 4226 section 5.3
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", code%1000000), nil
+}
+
+func promptOTP(username string) (string, error) {
+	fmt.Fprintf(os.Stderr, "Two-factor code for %s: ", username)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("not able to read the two-factor code: %w", err)
+	}
+	code := strings.TrimSpace(line)
+	if code == "" {
+		return "", ErrOTPRequired
+	}
+	return code, nil
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,41 @@
+package login
+
+import (
+	"testing"
+	"time"
+)
+
+// The SHA-1 vectors of RFC 6238 appendix B, cut to 6 digits.
+func TestTOTP(t *testing.T) {
+	// base32 of "12345678901234567890"
+	const secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		got, err := TOTP(secret, time.Unix(tt.unix, 0))
+		if err != nil || got != tt.want {
+			t.Errorf("TOTP(%d) = %q, %v, want %q", tt.unix, got, err, tt.want)
+		}
+	}
+}
+
+func TestTOTPSecretFormats(t *testing.T) {
+	at := time.Unix(59, 0)
+	for _, secret := range []string{"gezd gnbv gy3t qojq gezd gnbv gy3t qojq", " GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ=== "} {
+		if got, err := TOTP(secret, at); err != nil || got != "287082" {
+			t.Errorf("TOTP(%q) = %q, %v, want 287082", secret, got, err)
+		}
+	}
+	if _, err := TOTP("not base32!", at); err == nil {
+		t.Error("TOTP accepted a secret that is not base32")
+	}
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"fmt"
+	"flag"
 
+	"net/http"
 	"os"
+	"os/signal"
+	"peertubeupload/apiclient"
 	"peertubeupload/auth"
 	"peertubeupload/config"
 	"peertubeupload/database"
@@ -13,23 +17,102 @@ import (
 	"peertubeupload/login"
 	"peertubeupload/media"
 	"peertubeupload/model"
+	"peertubeupload/state"
+	"syscall"
 )
 
 var c config.Config
-var baseURL string
 
 func init() {
 	c.LoadConfiguration("config.json")
-	baseURL = fmt.Sprintf("%s:%s/api/v1", c.APIConfig.URL, c.APIConfig.Port)
 
 }
 
 func main() {
+	dryRun := flag.Bool("dry-run", false, "plan the batch without logging in or uploading anything")
+	report := flag.String("report", "", "write the dry run or sync-metadata report to this file, .json or .csv")
+	syncMetadata := flag.Bool("sync-metadata", false, "update the metadata of uploaded videos from the table instead of uploading, with --dry-run only report the differences")
+	flag.Parse()
+
+	if err := c.CheckLoadType(); err != nil {
+		logger.LogError(err.Error(), nil)
+		os.Exit(1)
+	}
 
 	var db *sql.DB
+	if *dryRun && !*syncMetadata {
+		var err error
+		if c.LoadType.LoadFromFolder {
+			err = media.PlanFromFileSystem(c, *report)
+		} else if c.LoadType.LoadPathFromDB {
+			// a dry run reads the tables, it never creates or alters the log
+			db, err = database.OpenDB(&c)
+			if err != nil {
+				logger.LogError(err.Error(), nil)
+				os.Exit(1)
+			}
+			defer db.Close()
+			err = media.PlanFromDB(db, &c, *report)
+		}
+		if err != nil {
+			logger.LogError("dry run failed", map[string]interface{}{"error": err})
+			os.Exit(1)
+		}
+		return
+	}
+
+	// The first SIGINT or SIGTERM stops new uploads and lets the ones in
+	// progress drain, stop() then restores the default handling so a second
+	// one kills the process right away.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	configured, err := c.UploadDestinations()
+	if err != nil {
+		logger.LogError(err.Error(), nil)
+		os.Exit(1)
+	}
 	client := httpclient.New()
-	var loginManager auth.Authenticator = &login.LoginManager{}
-	loginClient, err := loginManager.LoginPrerequisite(baseURL, client)
+	var destinations []media.Destination
+	loggedIn := 0
+	for _, d := range configured {
+		api, err := connect(client, d)
+		if err != nil {
+			// kept so its uploads fail and sources aren't disposed of as if
+			// every destination had them
+			logger.LogError("not able to log in, uploads to this destination fail", map[string]interface{}{"destination": d.Name, "error": err})
+			destinations = append(destinations, media.Destination{Destination: d, LoginErr: err})
+			continue
+		}
+		destinations = append(destinations, media.Destination{Destination: d, API: api})
+		loggedIn++
+	}
+	if loggedIn == 0 {
+		logger.LogError("not able to log in to any destination", nil)
+		os.Exit(1)
+	}
+
+	if *syncMetadata {
+		// sync-metadata only reads the tables, with --dry-run nothing at all
+		// may change
+		db, err = database.OpenDB(&c)
+		if err != nil {
+			logger.LogError(err.Error(), nil)
+			os.Exit(1)
+		}
+		defer db.Close()
+		if err := media.SyncMetadata(ctx, db, &c, destinations, *report, *dryRun); err != nil {
+			logger.LogError("metadata sync failed", map[string]interface{}{"error": err})
+			os.Exit(1)
+		}
+		return
+	}
+
+	store, err := state.Open(c.LoadType.StateFile)
 	if err != nil {
 		logger.LogError(err.Error(), nil)
 		os.Exit(1)
@@ -39,7 +122,7 @@ func main() {
 
 		filesChan := make(chan model.Media)
 
-		media.ProcessFromFileSystem(c, filesChan, loginClient, client, loginManager)
+		media.ProcessFromFileSystem(ctx, c, filesChan, destinations, store)
 
 	} else if c.LoadType.LoadPathFromDB {
 
@@ -53,7 +136,7 @@ func main() {
 			defer db.Close()
 		}
 
-		media.ProcessFromDB(db, &c, filesChan, loginClient, client, loginManager)
+		media.ProcessFromDB(ctx, db, &c, filesChan, destinations, store)
 
 	} else {
 		logger.LogError("You need to specify at least one load type either db or file", nil)
@@ -62,3 +145,18 @@ func main() {
 	}
 
 }
+
+// connect logs in to a destination once up front, so a wrong password or a
+// missing two-factor code is reported before any file is started.
+func connect(client *http.Client, d config.Destination) (*apiclient.Client, error) {
+	var loginManager auth.Authenticator = &login.LoginManager{TokenFile: d.TokenFile, OTPSecret: d.OTPSecret, PromptOTP: d.OTPPrompt}
+	loginClient, err := loginManager.LoginPrerequisite(d.BaseURL(), client)
+	if err != nil {
+		return nil, err
+	}
+	api := apiclient.New(client, loginManager, loginClient, d.BaseURL(), d.Username, d.Password)
+	if err := api.EnsureToken(); err != nil {
+		return nil, err
+	}
+	return api, nil
+}
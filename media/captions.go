@@ -0,0 +1,280 @@
+package media
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"peertubeupload/apiclient"
+	"peertubeupload/config"
+	"peertubeupload/logger"
+	"peertubeupload/model"
+	"regexp"
+	"strings"
+)
+
+var captionExtensions = map[string]bool{
+	".vtt": true,
+	".srt": true,
+}
+
+// iso639Languages maps the three letter codes found in file names and
+// container tags to the two letter codes PeerTube uses for captions.
+var iso639Languages = map[string]string{
+	"ara": "ar", "chi": "zh", "zho": "zh", "cze": "cs", "ces": "cs",
+	"dan": "da", "dut": "nl", "nld": "nl", "eng": "en", "fin": "fi",
+	"fre": "fr", "fra": "fr", "ger": "de", "deu": "de", "gre": "el",
+	"ell": "el", "heb": "he", "hin": "hi", "hun": "hu", "ind": "id",
+	"ita": "it", "jpn": "ja", "kor": "ko", "nor": "no", "per": "fa",
+	"fas": "fa", "pol": "pl", "por": "pt", "rum": "ro", "ron": "ro",
+	"rus": "ru", "spa": "es", "swe": "sv", "tha": "th", "tur": "tr",
+	"ukr": "uk", "urd": "ur", "vie": "vi",
+}
+
+var languageCodePattern = regexp.MustCompile(`^[a-z]{2,3}(-[a-z0-9]{2,4})?$`)
+
+// captionLanguage normalizes a language code to the form PeerTube expects.
+// It returns "" when code doesn't look like a language.
+func captionLanguage(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	if !languageCodePattern.MatchString(code) {
+		return ""
+	}
+	if short, ok := iso639Languages[code]; ok {
+		return short
+	}
+	return code
+}
+
+// findCaptionFiles lists the subtitle files next to mediaPath that share its
+// name, movie.en.srt or movie.vtt for movie.mp4. The language comes from the
+// part between the name and the extension, or defaultLanguage if there's none.
+func findCaptionFiles(mediaPath string, defaultLanguage string) []model.Caption {
+	entries, err := os.ReadDir(filepath.Dir(mediaPath))
+	if err != nil {
+		logger.LogWarning("not able to look for caption files", map[string]interface{}{"error": err, "file": mediaPath})
+		return nil
+	}
+
+	base := GetFileName(mediaPath)
+	var captions []model.Caption
+	for _, entry := range entries {
+		name := entry.Name()
+		ext := strings.ToLower(filepath.Ext(name))
+		if entry.IsDir() || !captionExtensions[ext] {
+			continue
+		}
+		stem := strings.TrimSuffix(name, filepath.Ext(name))
+		var language string
+		if stem == base {
+			language = defaultLanguage
+		} else if strings.HasPrefix(stem, base+".") {
+			language = strings.TrimPrefix(stem, base+".")
+		} else {
+			continue
+		}
+		captions = append(captions, model.Caption{
+			Language: language,
+			Path:     filepath.Join(filepath.Dir(mediaPath), name),
+		})
+	}
+	return captions
+}
+
+// captionsFromColumn reads a comma separated list of caption paths from a
+// dbConfig column, taking each language from the file name.
+func captionsFromColumn(value string, defaultLanguage string) []model.Caption {
+	var captions []model.Caption
+	for _, p := range strings.Split(value, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		language := defaultLanguage
+		stem := strings.TrimSuffix(filepath.Base(p), filepath.Ext(p))
+		if ext := filepath.Ext(stem); ext != "" && captionLanguage(ext[1:]) != "" {
+			language = ext[1:]
+		}
+		captions = append(captions, model.Caption{Language: language, Path: p})
+	}
+	return captions
+}
+
+// uploadCaptions attaches every caption of media to the uploaded video. A
+// failing caption is logged and doesn't stop the others.
+func uploadCaptions(c *config.Config, api *apiclient.Client, video model.VideoClass, media model.Media) {
+	if !c.CaptionConfig.Enabled {
+		return
+	}
+	captions := media.Captions
+	if c.CaptionConfig.ExtractEmbedded {
+		embedded := extractEmbeddedCaptions(c, media.FilePath)
+		defer func() {
+			for _, caption := range embedded {
+				os.Remove(caption.Path)
+			}
+		}()
+		captions = append(captions, embedded...)
+	}
+
+	// PeerTube keeps one caption per language, the first one found wins so
+	// files next to the media take precedence over embedded tracks
+	uploaded := map[string]bool{}
+	for _, caption := range captions {
+		language := captionLanguage(caption.Language)
+		if language == "" {
+			logger.LogWarning("caption has no usable language, skipping it", map[string]interface{}{"caption": caption.Path, "language": caption.Language})
+			continue
+		}
+		if uploaded[language] {
+			logger.LogInfo("Caption for this language already uploaded, skipping", map[string]interface{}{"caption": caption.Path, "language": language})
+			continue
+		}
+		uploaded[language] = true
+		if err := uploadCaption(c, api, video, language, caption.Path); err != nil {
+			logger.LogError("not able to upload caption", map[string]interface{}{"error": err, "caption": caption.Path, "uuid": video.UUID})
+			continue
+		}
+		logger.LogInfo("Caption uploaded", map[string]interface{}{"caption": caption.Path, "language": language, "uuid": video.UUID})
+	}
+}
+
+func uploadCaption(c *config.Config, api *apiclient.Client, video model.VideoClass, language string, captionPath string) error {
+	content, err := os.ReadFile(captionPath)
+	if err != nil {
+		return err
+	}
+	filename := filepath.Base(captionPath)
+	if c.CaptionConfig.ConvertSrtToVtt && strings.ToLower(filepath.Ext(captionPath)) == ".srt" {
+		content = srtToVtt(content)
+		filename = strings.TrimSuffix(filename, filepath.Ext(filename)) + ".vtt"
+	}
+
+	payload := &bytes.Buffer{}
+	writer := multipart.NewWriter(payload)
+	part, err := writer.CreateFormFile("captionfile", filename)
+	if err != nil {
+		return err
+	}
+	if _, err := part.Write(content); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	res, err := api.Do(func() (*http.Request, error) {
+		req, err := http.NewRequest("PUT", fmt.Sprintf("%s/videos/%s/captions/%s", api.BaseURL, video.UUID, language), bytes.NewReader(payload.Bytes()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK {
+		return fmt.Errorf("caption upload returned %s: %s", res.Status, body)
+	}
+	return nil
+}
+
+var srtTimestamp = regexp.MustCompile(`(\d{2}:\d{2}:\d{2}),(\d{3})`)
+
+// srtToVtt converts SubRip to WebVTT. Cue numbers are kept, WebVTT reads them
+// as cue identifiers.
+func srtToVtt(srt []byte) []byte {
+	text := strings.TrimPrefix(string(srt), "\ufeff")
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+
+	var b strings.Builder
+	b.WriteString("WEBVTT\n\n")
+	for _, line := range strings.Split(text, "\n") {
+		if strings.Contains(line, "-->") {
+			line = srtTimestamp.ReplaceAllString(line, "$1.$2")
+		}
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	return []byte(b.String())
+}
+
+// textSubtitleCodecs are the subtitle codecs ffmpeg can turn into WebVTT.
+// Bitmap subtitles (PGS, VobSub) would need OCR and are left out.
+var textSubtitleCodecs = map[string]bool{
+	"subrip":   true,
+	"srt":      true,
+	"ass":      true,
+	"ssa":      true,
+	"webvtt":   true,
+	"mov_text": true,
+	"text":     true,
+}
+
+// extractEmbeddedCaptions writes every text subtitle stream of mediaPath to a
+// WebVTT file in loadType.tempFolder. The caller removes the files.
+func extractEmbeddedCaptions(c *config.Config, mediaPath string) []model.Caption {
+	metadata, err := getMetaData(mediaPath)
+	if err != nil {
+		return nil
+	}
+
+	// Forced tracks usually only carry foreign dialogue, try the full ones first
+	var streams []model.Stream
+	for _, stream := range metadata.Streams {
+		if stream.CodecType == "subtitle" && stream.Disposition["forced"] == 0 {
+			streams = append(streams, stream)
+		}
+	}
+	for _, stream := range metadata.Streams {
+		if stream.CodecType == "subtitle" && stream.Disposition["forced"] != 0 {
+			streams = append(streams, stream)
+		}
+	}
+
+	var captions []model.Caption
+	for _, stream := range streams {
+		if !textSubtitleCodecs[stream.CodecName] {
+			logger.LogInfo("Skipping subtitle stream that is not text", map[string]interface{}{"file": mediaPath, "stream": stream.Index, "codec": stream.CodecName})
+			continue
+		}
+		language := stream.Tags.Language
+		if language == "" || language == "und" {
+			language = c.CaptionConfig.DefaultLanguage
+		}
+
+		out, err := tempFilePath(c, fmt.Sprintf("%s.%d.%s.*.vtt", GetFileName(mediaPath), stream.Index, language))
+		if err != nil {
+			logger.LogWarning("not able to create temp file for subtitle stream", map[string]interface{}{"error": err, "file": mediaPath})
+			continue
+		}
+		cmd := exec.Command("ffmpeg", "-v", "error", "-y", "-i", mediaPath, "-map", fmt.Sprintf("0:%d", stream.Index), "-f", "webvtt", out)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			logger.LogWarning("not able to extract subtitle stream", map[string]interface{}{"error": err, "file": mediaPath, "stream": stream.Index, "ffmpeg": stderr.String()})
+			os.Remove(out)
+			continue
+		}
+		captions = append(captions, model.Caption{Language: language, Path: out})
+	}
+	return captions
+}
+
+// tempFilePath reserves a unique file in loadType.tempFolder for ffmpeg to
+// overwrite, so files with the same name in different folders can't collide.
+func tempFilePath(c *config.Config, pattern string) (string, error) {
+	f, err := os.CreateTemp(c.LoadType.TempFolder, pattern)
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+	return f.Name(), nil
+}
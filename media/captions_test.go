@@ -0,0 +1,79 @@
+package media
+
+import (
+	"os"
+	"path/filepath"
+	"peertubeupload/model"
+	"reflect"
+	"testing"
+)
+
+func TestSrtToVtt(t *testing.T) {
+	tests := []struct {
+		name string
+		srt  string
+		want string
+	}{
+		{
+			"timestamps",
+			"1\n00:00:01,500 --> 00:00:03,250\nHello\n",
+			"WEBVTT\n\n1\n00:00:01.500 --> 00:00:03.250\nHello\n\n",
+		},
+		{
+			"bom and crlf",
+			"\ufeff1\r\n00:01:00,000 --> 00:01:02,000\r\nBonjour\r\n",
+			"WEBVTT\n\n1\n00:01:00.000 --> 00:01:02.000\nBonjour\n\n",
+		},
+		{
+			"commas in text kept",
+			"2\n00:00:04,000 --> 00:00:05,000\nWell, 10,000 people\n",
+			"WEBVTT\n\n2\n00:00:04.000 --> 00:00:05.000\nWell, 10,000 people\n\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(srtToVtt([]byte(tt.srt))); got != tt.want {
+				t.Errorf("srtToVtt() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindCaptionFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"movie.mp4", "movie.srt", "movie.en.vtt", "movie.fre.srt", "movie.txt", "other.srt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := findCaptionFiles(filepath.Join(dir, "movie.mp4"), "de")
+	want := []model.Caption{
+		{Language: "en", Path: filepath.Join(dir, "movie.en.vtt")},
+		{Language: "fre", Path: filepath.Join(dir, "movie.fre.srt")},
+		{Language: "de", Path: filepath.Join(dir, "movie.srt")},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("findCaptionFiles() = %v, want %v", got, want)
+	}
+}
+
+func TestCaptionLanguage(t *testing.T) {
+	tests := []struct {
+		code string
+		want string
+	}{
+		{"en", "en"},
+		{" FR ", "fr"},
+		{"fre", "fr"},
+		{"deu", "de"},
+		{"pt-br", "pt-br"},
+		{"forced", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := captionLanguage(tt.code); got != tt.want {
+			t.Errorf("captionLanguage(%q) = %q, want %q", tt.code, got, tt.want)
+		}
+	}
+}
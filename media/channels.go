@@ -0,0 +1,247 @@
+package media
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"peertubeupload/apiclient"
+	"peertubeupload/config"
+	"peertubeupload/logger"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type channelRule struct {
+	pattern *regexp.Regexp
+	channel string
+}
+
+var (
+	channelRulesOnce sync.Once
+	channelRules     []channelRule
+)
+
+// routeChannel picks the channel of a file from channelConfig: the first
+// rule whose pattern matches the path, then with fromSubfolder the top-level
+// subfolder under folderConfig.path. It returns "" to keep the channelId of
+// the destination.
+func routeChannel(c *config.Config, path string) string {
+	channelRulesOnce.Do(func() {
+		for _, rule := range c.ChannelConfig.Rules {
+			pattern, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				logger.LogError("channel rule pattern is not a valid regular expression, ignoring it", map[string]interface{}{"error": err, "pattern": rule.Pattern})
+				continue
+			}
+			channelRules = append(channelRules, channelRule{pattern: pattern, channel: rule.Channel})
+		}
+	})
+
+	slashed := filepath.ToSlash(path)
+	for _, rule := range channelRules {
+		if match := rule.pattern.FindStringSubmatchIndex(slashed); match != nil {
+			return string(rule.pattern.ExpandString(nil, rule.channel, slashed, match))
+		}
+	}
+	if c.ChannelConfig.FromSubfolder {
+		return topLevelSubfolder(c.FolderConfig.Path, path)
+	}
+	return ""
+}
+
+// topLevelSubfolder returns the folder right under root that holds path, ""
+// for files directly in root or outside of it.
+func topLevelSubfolder(root string, path string) string {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return ""
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[0]
+}
+
+type videoChannel struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+// channelResolver turns the channel names, handles and ids found by routing
+// into channel ids on one destination. Lookups are cached for the run.
+type channelResolver struct {
+	mutex sync.Mutex
+	ids   map[string]int
+}
+
+// resolve finds the channel of the logged in account whose handle or display
+// name is value, or with allowID whose id it is. Ids differ between
+// instances, so an id must belong to the account on this destination. With
+// channelConfig.create a missing channel is created.
+func (r *channelResolver) resolve(c *config.Config, api *apiclient.Client, value string, allowID bool) (int, error) {
+	value = strings.TrimSpace(value)
+	id, err := strconv.Atoi(value)
+	byID := allowID && err == nil && id > 0
+	// a full handle is name@host, only the name is compared
+	handle, _, _ := strings.Cut(strings.TrimPrefix(value, "@"), "@")
+
+	// held while creating too, so two files don't create the same channel
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	key := strings.ToLower(value)
+	if byID {
+		key = "#" + value
+	}
+	if cached, ok := r.ids[key]; ok {
+		return cached, nil
+	}
+
+	channels, err := listChannels(api)
+	if err != nil {
+		return 0, fmt.Errorf("not able to list channels: %w", err)
+	}
+	if byID {
+		for _, channel := range channels {
+			if channel.ID == id {
+				r.remember(key, id)
+				return id, nil
+			}
+		}
+		return 0, fmt.Errorf("channel id %d is not a channel of %s on this instance", id, api.Username)
+	}
+	for _, channel := range channels {
+		if strings.EqualFold(channel.Name, handle) || strings.EqualFold(channel.DisplayName, value) {
+			r.remember(key, channel.ID)
+			return channel.ID, nil
+		}
+	}
+
+	if !c.ChannelConfig.Create {
+		return 0, fmt.Errorf("channel %q doesn't exist on the instance, create it or enable channelConfig.create", value)
+	}
+	id, err = createChannel(api, value, c.ChannelConfig.Description)
+	if err != nil {
+		return 0, fmt.Errorf("not able to create channel %q: %w", value, err)
+	}
+	logger.LogInfo("Channel created", map[string]interface{}{"channel": value, "id": id})
+	r.remember(key, id)
+	return id, nil
+}
+
+func (r *channelResolver) remember(key string, id int) {
+	if r.ids == nil {
+		r.ids = map[string]int{}
+	}
+	r.ids[key] = id
+}
+
+// listChannels returns every channel of the account api is logged in as.
+func listChannels(api *apiclient.Client) ([]videoChannel, error) {
+	var channels []videoChannel
+	for {
+		res, err := api.Do(func() (*http.Request, error) {
+			return http.NewRequest("GET", fmt.Sprintf("%s/accounts/%s/video-channels?start=%d&count=100", api.BaseURL, url.PathEscape(api.Username), len(channels)), nil)
+		})
+		if err != nil {
+			return nil, err
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("channel list returned %s: %s", res.Status, body)
+		}
+
+		var page struct {
+			Total int            `json:"total"`
+			Data  []videoChannel `json:"data"`
+		}
+		if err := json.Unmarshal(body, &page); err != nil {
+			return nil, err
+		}
+		channels = append(channels, page.Data...)
+		if len(page.Data) == 0 || len(channels) >= page.Total {
+			return channels, nil
+		}
+	}
+}
+
+// createChannel creates a channel shown as displayName, with a handle made
+// from it, and returns its id.
+func createChannel(api *apiclient.Client, displayName string, description string) (int, error) {
+	payload := map[string]interface{}{
+		"name":        channelHandle(displayName, api.Username),
+		"displayName": truncate(displayName, 50),
+	}
+	// PeerTube wants at least 3 characters of description, or none
+	if len(description) >= 3 {
+		payload["description"] = description
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := api.Do(func() (*http.Request, error) {
+		req, err := http.NewRequest("POST", api.BaseURL+"/video-channels", bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return 0, err
+	}
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusCreated {
+		return 0, fmt.Errorf("channel creation returned %s: %s", res.Status, body)
+	}
+
+	var created struct {
+		VideoChannel struct {
+			ID int `json:"id"`
+		} `json:"videoChannel"`
+	}
+	if err := json.Unmarshal(body, &created); err != nil {
+		return 0, err
+	}
+	return created.VideoChannel.ID, nil
+}
+
+var invalidHandleChars = regexp.MustCompile(`[^a-z0-9_.]+`)
+
+// channelHandle makes a valid channel handle out of a display name. PeerTube
+// refuses a handle equal to the account name, so that one gets a suffix.
+func channelHandle(displayName string, username string) string {
+	handle := strings.Trim(invalidHandleChars.ReplaceAllString(strings.ToLower(displayName), "_"), "_.")
+	if handle == "" {
+		handle = "channel"
+	}
+	if strings.EqualFold(handle, username) {
+		handle += "_channel"
+	}
+	return truncate(handle, 50)
+}
+
+func truncate(value string, max int) string {
+	runes := []rune(value)
+	if len(runes) <= max {
+		return value
+	}
+	return string(runes[:max])
+}
@@ -0,0 +1,74 @@
+package media
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"peertubeupload/apiclient"
+	"peertubeupload/config"
+	"peertubeupload/login"
+	"testing"
+)
+
+func TestChannelHandle(t *testing.T) {
+	tests := []struct {
+		displayName string
+		username    string
+		want        string
+	}{
+		{"My Channel", "alice", "my_channel"},
+		{"  Été 2024! ", "alice", "t_2024"},
+		{"alice", "alice", "alice_channel"},
+		{"***", "alice", "channel"},
+		{"a.b_c", "alice", "a.b_c"},
+	}
+	for _, tt := range tests {
+		if got := channelHandle(tt.displayName, tt.username); got != tt.want {
+			t.Errorf("channelHandle(%q, %q) = %q, want %q", tt.displayName, tt.username, got, tt.want)
+		}
+	}
+}
+
+// testAPI serves the channels of the account at /api/v1/accounts/alice/video-channels.
+func testAPI(t *testing.T, channels []videoChannel) *apiclient.Client {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/accounts/alice/video-channels" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"total": len(channels), "data": channels})
+	}))
+	t.Cleanup(server.Close)
+	return apiclient.New(server.Client(), &login.LoginManager{}, nil, server.URL+"/api/v1", "alice", "")
+}
+
+func TestChannelResolverResolve(t *testing.T) {
+	api := testAPI(t, []videoChannel{
+		{ID: 7, Name: "music", DisplayName: "Music"},
+		{ID: 9, Name: "2024", DisplayName: "Year 2024"},
+	})
+	c := &config.Config{}
+
+	tests := []struct {
+		value   string
+		allowID bool
+		want    int
+		wantErr bool
+	}{
+		{"music", false, 7, false},
+		{"@music@example.org", false, 7, false},
+		{"Year 2024", false, 9, false},
+		// a subfolder named 2024 is the channel named 2024, not id 2024
+		{"2024", false, 9, false},
+		{"7", true, 7, false},
+		{"2024", true, 0, true},
+		{"missing", false, 0, true},
+	}
+	for _, tt := range tests {
+		var r channelResolver
+		got, err := r.resolve(c, api, tt.value, tt.allowID)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("resolve(%q, %v) = %d, %v, want %d, error %v", tt.value, tt.allowID, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
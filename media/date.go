@@ -0,0 +1,143 @@
+package media
+
+import (
+	"os"
+	"peertubeupload/config"
+	"peertubeupload/logger"
+	"peertubeupload/model"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Date sources accepted in loadType.dateSources.
+const (
+	DateSourceDB        = "db"
+	DateSourceSidecar   = "sidecar"
+	DateSourceContainer = "container"
+	DateSourceQuickTime = "quicktime"
+	DateSourceFilename  = "filename"
+	DateSourceMtime     = "mtime"
+)
+
+var defaultDateSources = []string{DateSourceDB, DateSourceSidecar, DateSourceContainer, DateSourceQuickTime, DateSourceFilename, DateSourceMtime}
+
+var (
+	filenameDateOnce    sync.Once
+	filenameDatePattern *regexp.Regexp
+)
+
+// resolveCreateDate sets media.CreateDate from the first source in
+// loadType.dateSources that has a date. ffprobe only runs if a container
+// source is reached. Without any date, today is used.
+func resolveCreateDate(c *config.Config, media *model.Media) {
+	sources := c.LoadType.DateSources
+	if len(sources) == 0 {
+		sources = defaultDateSources
+	}
+
+	var metadata *model.Metadata
+	probe := func() *model.Metadata {
+		if metadata == nil {
+			m, err := getMetaData(media.FilePath)
+			if err != nil {
+				m = model.Metadata{}
+			}
+			metadata = &m
+		}
+		return metadata
+	}
+
+	remote := isRemote(media.FilePath)
+	for _, source := range sources {
+		var date time.Time
+		switch source {
+		case DateSourceDB, DateSourceSidecar:
+			date = media.DateCandidates[source]
+		case DateSourceContainer:
+			// URLs are not probed, PeerTube reads the file once it has it
+			if !remote {
+				date = containerDate(probe())
+			}
+		case DateSourceQuickTime:
+			if !remote {
+				date = parseTagDate(probe().Format.Tags.QuickTimeCreationDate)
+			}
+		case DateSourceFilename:
+			date = filenameDate(c, media.FilePath)
+		case DateSourceMtime:
+			if info, err := os.Stat(media.FilePath); err == nil {
+				date = info.ModTime()
+			}
+		default:
+			logger.LogWarning("unknown date source in dateSources", map[string]interface{}{"source": source})
+		}
+		if !date.IsZero() {
+			media.CreateDate = date
+			return
+		}
+	}
+
+	logger.LogWarning("no original date found, today date will be submitted", map[string]interface{}{"file": media.FilePath})
+	media.CreateDate = time.Now()
+}
+
+// containerDate reads creation_time from the format tags, then the streams.
+func containerDate(metadata *model.Metadata) time.Time {
+	if date := parseTagDate(metadata.Format.Tags.CreationTime); !date.IsZero() {
+		return date
+	}
+	for _, stream := range metadata.Streams {
+		if date := parseTagDate(stream.Tags.CreationTime); !date.IsZero() {
+			return date
+		}
+	}
+	return time.Time{}
+}
+
+// parseTagDate parses a date tag written by a muxer. Muxers that don't know
+// the date write the epoch of their format instead, those are ignored.
+func parseTagDate(value string) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+	date, err := parseDate(value)
+	if err != nil || date.Year() <= 1970 {
+		return time.Time{}
+	}
+	return date
+}
+
+// filenameDate matches loadType.filenameDatePattern against the file name
+// and parses the first group, or the whole match, with filenameDateLayout.
+func filenameDate(c *config.Config, filePath string) time.Time {
+	filenameDateOnce.Do(func() {
+		if c.LoadType.FilenameDatePattern == "" {
+			return
+		}
+		pattern, err := regexp.Compile(c.LoadType.FilenameDatePattern)
+		if err != nil {
+			logger.LogError("filenameDatePattern is not a valid regular expression", map[string]interface{}{"error": err})
+			return
+		}
+		filenameDatePattern = pattern
+	})
+	if filenameDatePattern == nil {
+		return time.Time{}
+	}
+
+	match := filenameDatePattern.FindStringSubmatch(GetFileName(filePath))
+	if match == nil {
+		return time.Time{}
+	}
+	value := match[0]
+	if len(match) > 1 {
+		value = match[1]
+	}
+	date, err := time.ParseInLocation(c.LoadType.FilenameDateLayout, value, time.Local)
+	if err != nil {
+		logger.LogWarning("date in file name doesn't match filenameDateLayout", map[string]interface{}{"file": filePath, "value": value})
+		return time.Time{}
+	}
+	return date
+}
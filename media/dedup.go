@@ -0,0 +1,139 @@
+package media
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"peertubeupload/apiclient"
+	"peertubeupload/config"
+	"peertubeupload/logger"
+	"peertubeupload/medialog"
+	"peertubeupload/model"
+)
+
+// loadUploadIndex reads back the log selected by loadType.logType so media
+// uploaded by an earlier run can be skipped. It returns nil when
+// loadType.skipUploaded is off or the log can't be read.
+func loadUploadIndex(c *config.Config, db *sql.DB) *medialog.Index {
+	if !c.LoadType.SkipUploaded {
+		return nil
+	}
+
+	var index *medialog.Index
+	var err error
+	switch {
+	case c.LoadType.LogType == "file":
+		index, err = medialog.LoadFileIndex(medialog.LogFile, c)
+	case c.LoadType.LogType == "db" && db != nil:
+		index, err = medialog.LoadDBIndex(db, c)
+	default:
+		logger.LogWarning("skipUploaded needs a file or db log to know what was uploaded, nothing will be skipped", map[string]interface{}{"logType": c.LoadType.LogType})
+		return nil
+	}
+	if err != nil {
+		logger.LogError("not able to read the upload log, nothing will be skipped", map[string]interface{}{"error": err})
+		return nil
+	}
+	return index
+}
+
+// alreadyUploaded reports whether media was uploaded to destination by an
+// earlier run, looking it up by key and, with loadType.matchByHash, by
+// content hash. With loadType.verifyRemote the video must also still exist
+// on the instance.
+func alreadyUploaded(c *config.Config, index *medialog.Index, destination string, key string, media *model.Media, api *apiclient.Client) (model.VideoClass, bool) {
+	ensureHash(c, media)
+	key, hash := medialog.Scope(destination, key), medialog.Scope(destination, media.Hash)
+	video, found := index.Lookup(key, hash)
+	if !found {
+		return model.VideoClass{}, false
+	}
+
+	// the dry run has no client and never asks the instance
+	if c.LoadType.VerifyRemote && api != nil {
+		exists, err := videoExists(api, video)
+		if err != nil {
+			logger.LogWarning("not able to check the video on the instance, assuming it still exists", map[string]interface{}{"error": err, "uuid": video.UUID})
+			return video, true
+		}
+		if !exists {
+			logger.LogInfo("uploaded video is gone from the instance, uploading again", map[string]interface{}{"uuid": video.UUID, "file": media.FilePath})
+			index.Remove(key, hash)
+			return model.VideoClass{}, false
+		}
+	}
+	return video, true
+}
+
+// changedSinceUpload finds the video media was uploaded as to destination
+// when loadType.replaceChanged is on and the file changed since, its file is
+// then replaced rather than uploaded again.
+func changedSinceUpload(c *config.Config, index *medialog.Index, destination string, key string, media *model.Media) (model.VideoClass, bool) {
+	// imports have no file of their own to swap in
+	if !c.LoadType.ReplaceChanged || importField(media.FilePath) != "" {
+		return model.VideoClass{}, false
+	}
+	ensureHash(c, media)
+	return index.Changed(medialog.Scope(destination, key), medialog.Scope(destination, media.Hash))
+}
+
+// ensureHash stores the hash of media with loadType.matchByHash, so it is
+// computed once per file and ends up in the log.
+func ensureHash(c *config.Config, media *model.Media) {
+	// there is nothing local to hash behind a URL
+	if !c.LoadType.MatchByHash || media.Hash != "" || isRemote(media.FilePath) {
+		return
+	}
+	hash, err := HashFile(media.FilePath)
+	if err != nil {
+		logger.LogWarning("not able to hash file", map[string]interface{}{"error": err, "file": media.FilePath})
+	}
+	media.Hash = hash
+}
+
+// videoID is how the API addresses video, by uuid when the log has one.
+func videoID(video model.VideoClass) string {
+	if video.UUID == "" {
+		return fmt.Sprintf("%d", video.ID)
+	}
+	return video.UUID
+}
+
+func videoExists(api *apiclient.Client, video model.VideoClass) (bool, error) {
+	res, err := api.Do(func() (*http.Request, error) {
+		return http.NewRequest("GET", fmt.Sprintf("%s/videos/%s", api.BaseURL, videoID(video)), nil)
+	})
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, res.Body)
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected status %s", res.Status)
+	}
+}
+
+// HashFile returns the hex sha256 of the whole file.
+func HashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,295 @@
+package media
+
+import (
+	"context"
+	"os"
+	"peertubeupload/apiclient"
+	"peertubeupload/config"
+	"peertubeupload/logger"
+	"peertubeupload/medialog"
+	"peertubeupload/model"
+	"peertubeupload/state"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// Destination is a PeerTube instance and account uploads go to, with the
+// client logged in to it.
+type Destination struct {
+	config.Destination
+	API *apiclient.Client
+	// LoginErr is why logging in failed at startup, every upload to the
+	// destination then fails with it, so no source counts as on every
+	// destination
+	LoginErr error
+}
+
+// target is a destination during a run, with its upload limits.
+type target struct {
+	Destination
+	// sem is nil when the destination has no threads limit of its own
+	sem       *semaphore.Weighted
+	limiter   *rateLimiter
+	channels  channelResolver
+	playlists playlistResolver
+}
+
+func newTargets(destinations []Destination) []*target {
+	targets := make([]*target, 0, len(destinations))
+	for _, d := range destinations {
+		t := &target{Destination: d}
+		if d.Threads > 0 {
+			t.sem = semaphore.NewWeighted(int64(d.Threads))
+		}
+		if d.UploadsPerHour > 0 {
+			t.limiter = &rateLimiter{interval: time.Hour / time.Duration(d.UploadsPerHour)}
+		}
+		targets = append(targets, t)
+	}
+	return targets
+}
+
+// acquire waits for a free upload slot on the destination and for its rate
+// limit. release must be called once the upload is done.
+func (t *target) acquire(ctx context.Context) error {
+	if t.sem != nil {
+		if err := t.sem.Acquire(ctx, 1); err != nil {
+			return err
+		}
+	}
+	if err := t.limiter.wait(ctx); err != nil {
+		t.release()
+		return err
+	}
+	return nil
+}
+
+func (t *target) release() {
+	if t.sem != nil {
+		t.sem.Release(1)
+	}
+}
+
+// rateLimiter spaces out the start of uploads by interval. A nil
+// *rateLimiter never waits.
+type rateLimiter struct {
+	mutex    sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func (l *rateLimiter) wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	l.mutex.Lock()
+	start := time.Now()
+	if l.next.After(start) {
+		start = l.next
+	}
+	l.next = start.Add(l.interval)
+	l.mutex.Unlock()
+
+	return sleepContext(ctx, time.Until(start))
+}
+
+// selectTargets returns the targets media goes to.
+func selectTargets(targets []*target, media model.Media) []*target {
+	var selected []*target
+	for _, t := range targets {
+		if wantsDestination(media, t.Name) {
+			selected = append(selected, t)
+		}
+	}
+	return selected
+}
+
+// wantsDestination reports whether media goes to the named destination, it
+// goes to all of them unless media.Destinations names some.
+func wantsDestination(media model.Media, name string) bool {
+	if len(media.Destinations) == 0 {
+		return true
+	}
+	for _, wanted := range media.Destinations {
+		if strings.EqualFold(wanted, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// destinationResult is how the upload of a media to one destination went.
+type destinationResult struct {
+	target *target
+	video  model.VideoClass
+	// replace is the video whose file is swapped, nil for a new upload
+	replace *model.VideoClass
+	skipped bool
+	err     error
+}
+
+// uploadEverywhere uploads media to every destination selected for it, in
+// parallel. A destination that fails doesn't stop the others. logResult is
+// called for each finished upload, replaced tells whether the file of an
+// existing video was swapped.
+func uploadEverywhere(ctx context.Context, c *config.Config, targets []*target, index *medialog.Index, key string, media model.Media, store *state.Store, logResult func(t *target, media model.Media, video model.Video, replaced bool)) []destinationResult {
+	selected := selectTargets(targets, media)
+	if len(selected) == 0 {
+		logger.LogWarning("no destination selected, skipping", map[string]interface{}{"file": media.FilePath})
+		return nil
+	}
+
+	ensureHash(c, &media)
+	results := make([]destinationResult, len(selected))
+	var pending []int
+	for i, t := range selected {
+		results[i].target = t
+		if t.LoginErr != nil {
+			results[i].err = t.LoginErr
+			continue
+		}
+		if err := t.API.EnsureToken(); err != nil {
+			logger.LogError("Unable to get access token", map[string]interface{}{"error": err, "destination": t.Name})
+			results[i].err = err
+			continue
+		}
+		if previous, changed := changedSinceUpload(c, index, t.Name, key, &media); changed {
+			logger.LogInfo("File changed since its upload, replacing it", map[string]interface{}{"file": media.FilePath, "uuid": previous.UUID, "destination": t.Name})
+			results[i].replace = &previous
+			pending = append(pending, i)
+			continue
+		}
+		if uploaded, found := alreadyUploaded(c, index, t.Name, key, &media, t.API); found {
+			logger.LogInfo("Already uploaded, skipping", map[string]interface{}{"file": media.FilePath, "uuid": uploaded.UUID, "destination": t.Name})
+			results[i].video = uploaded
+			results[i].skipped = true
+			rememberUploaded(c, t, uploaded, media)
+			continue
+		}
+		pending = append(pending, i)
+	}
+	if len(pending) == 0 {
+		return results
+	}
+
+	resolveCreateDate(c, &media)
+	// converted once for every destination, before waiting for their slots
+	if c.LoadType.ConvertAudioToMp3 && importField(media.FilePath) == "" {
+		converted, err := audioAsMp3(c, media.FilePath)
+		if err != nil {
+			logger.LogError("not able to convert audio to mp3", map[string]interface{}{"error": err, "file": media.FilePath})
+			for _, i := range pending {
+				results[i].err = err
+			}
+			return results
+		}
+		if converted != "" {
+			defer os.Remove(converted)
+			media.ConvertedPath = converted
+		}
+	}
+	var wg sync.WaitGroup
+	for _, i := range pending {
+		wg.Add(1)
+		go func(result *destinationResult) {
+			defer wg.Done()
+			t := result.target
+			destination := t.Destination.Destination
+			if media.Channel != "" && result.replace == nil {
+				id, err := t.channels.resolve(c, t.API, media.Channel, !media.ChannelRouted)
+				if err != nil {
+					logger.LogError("not able to find the channel", map[string]interface{}{"error": err, "file": media.FilePath, "destination": t.Name})
+					result.err = err
+					return
+				}
+				destination.ChannelID = id
+			}
+			if err := t.acquire(ctx); err != nil {
+				result.err = err
+				return
+			}
+
+			var video model.Video
+			var err error
+			switch {
+			case result.replace != nil:
+				video, err = ReplaceMediaInChunksOS(ctx, c, destination, media, *result.replace, t.API, store)
+			case importField(media.FilePath) != "":
+				video, err = ImportMedia(ctx, c, destination, media, t.API)
+			default:
+				video, err = UploadMediaInChunksOS(ctx, c, destination, media, t.API, store)
+			}
+			// waiting for transcoding frees the slot of the destination, the
+			// processConfig.threads slot stays taken until verification ends
+			t.release()
+			if err != nil {
+				logger.LogError("error uploading media", map[string]interface{}{"error": err, "file": media.FilePath, "destination": t.Name})
+				result.err = err
+				return
+			}
+			result.video = video.Video
+			// a replaced video keeps its captions, thumbnail and playlists
+			if result.replace == nil {
+				uploadCaptions(c, t.API, video.Video, media)
+				uploadThumbnail(c, t.API, video.Video, media)
+				addToPlaylist(c, t, destination.ChannelID, video.Video, media)
+			}
+
+			if c.VerificationConfig.Enabled {
+				video.Verification, err = verifyVideo(ctx, c, t.API, video.Video)
+				switch {
+				case video.Verification == nil:
+					// stopped by a shutdown, the upload itself is done
+					logger.LogWarning("video state not verified", map[string]interface{}{"error": err, "uuid": video.Video.UUID, "destination": t.Name})
+				case video.Verification.State == model.VerificationTimeout:
+					// the video may still get published, it counts as uploaded
+					logger.LogWarning("video not published yet, not waiting any longer", map[string]interface{}{"error": err, "state": video.Verification.Label, "uuid": video.Video.UUID, "destination": t.Name})
+				case err != nil:
+					logger.LogError("video not published", map[string]interface{}{"error": err, "state": video.Verification.Label, "uuid": video.Video.UUID, "destination": t.Name})
+					result.err = err
+					if result.replace != nil {
+						// the log keeps the previous hash, so the next run
+						// replaces the file of the same video again
+						return
+					}
+					// logged as failed and left out of the index, the next run
+					// uploads the file again. The failed video stays on the
+					// instance unless verificationConfig.deleteFailed
+					if c.VerificationConfig.DeleteFailed {
+						discardFailedVideo(t, video.Video)
+					}
+					logResult(t, media, video, false)
+					return
+				default:
+					logger.LogInfo("Video published", map[string]interface{}{"uuid": video.Video.UUID, "duration": video.Verification.Duration, "resolutions": video.Verification.Resolutions, "destination": t.Name})
+				}
+			}
+			index.Add(medialog.Scope(t.Name, key), medialog.Scope(t.Name, media.Hash), video.Video)
+			logResult(t, media, video, result.replace != nil)
+		}(&results[i])
+	}
+	wg.Wait()
+	return results
+}
+
+// allSkipped reports whether media was already on every destination.
+func allSkipped(results []destinationResult) bool {
+	for _, r := range results {
+		if !r.skipped {
+			return false
+		}
+	}
+	return true
+}
+
+func allSucceeded(results []destinationResult) bool {
+	for _, r := range results {
+		if r.err != nil {
+			return false
+		}
+	}
+	return len(results) > 0
+}
@@ -0,0 +1,204 @@
+package media
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"peertubeupload/config"
+	"peertubeupload/logger"
+	"regexp"
+	"strings"
+)
+
+// Actions accepted in dispositionConfig.onSuccess and onFailure.
+const (
+	DispositionKeep   = "keep"
+	DispositionMove   = "move"
+	DispositionRename = "rename"
+	DispositionDelete = "delete"
+)
+
+// uuidSuffix matches the end of a name renamed after its upload.
+var uuidSuffix = regexp.MustCompile(`\.[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// disposeSource applies dispositionConfig to the source file once it was
+// uploaded to every destination, or failed on one of them. Deleting needs
+// each instance to confirm its video exists, otherwise the file is kept.
+func disposeSource(c *config.Config, filePath string, results []destinationResult, succeeded bool) {
+	action := c.DispositionConfig.OnFailure
+	folder := c.DispositionConfig.FailedFolder
+	if succeeded {
+		action = c.DispositionConfig.OnSuccess
+		folder = c.DispositionConfig.DoneFolder
+	}
+
+	if isRemote(filePath) {
+		return
+	}
+
+	var err error
+	switch action {
+	case "", DispositionKeep:
+		return
+	case DispositionMove:
+		err = moveToFolder(c, filePath, folder)
+	case DispositionRename:
+		// with several destinations the name gets the uuid on the first one
+		if !succeeded || len(results) == 0 || results[0].video.UUID == "" {
+			logger.LogWarning("rename needs the uploaded video's uuid, keeping the file", map[string]interface{}{"file": filePath})
+			return
+		}
+		err = renameWithUUID(filePath, results[0].video.UUID)
+	case DispositionDelete:
+		if !succeeded {
+			logger.LogWarning("failed uploads are never deleted, keeping the file", map[string]interface{}{"file": filePath})
+			return
+		}
+		for _, r := range results {
+			exists, checkErr := videoExists(r.target.API, r.video)
+			if checkErr != nil || !exists {
+				logger.LogWarning("instance didn't confirm the video exists, keeping the file", map[string]interface{}{"file": filePath, "uuid": r.video.UUID, "destination": r.target.Name, "error": checkErr})
+				return
+			}
+		}
+		err = os.Remove(filePath)
+	default:
+		logger.LogWarning("unknown disposition action, keeping the file", map[string]interface{}{"action": action, "file": filePath})
+		return
+	}
+
+	if err != nil {
+		logger.LogError("not able to dispose of source file", map[string]interface{}{"error": err, "action": action, "file": filePath})
+		return
+	}
+	logger.LogInfo("Source file disposed", map[string]interface{}{"action": action, "file": filePath})
+}
+
+// moveToFolder moves filePath and its sidecars into folder, keeping the
+// layout it had under dispositionConfig.sourceRoot (folderConfig.path if
+// unset). Files outside of the root land directly in folder.
+func moveToFolder(c *config.Config, filePath string, folder string) error {
+	root := c.DispositionConfig.SourceRoot
+	if root == "" {
+		root = c.FolderConfig.Path
+	}
+
+	rel, err := filepath.Rel(root, filePath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		rel = filepath.Base(filePath)
+	}
+	target := filepath.Join(folder, rel)
+
+	if err := moveFile(filePath, target); err != nil {
+		return err
+	}
+	for _, companion := range companionFiles(filePath) {
+		if err := moveFile(companion, filepath.Join(filepath.Dir(target), filepath.Base(companion))); err != nil {
+			logger.LogWarning("not able to move sidecar file", map[string]interface{}{"error": err, "file": companion})
+		}
+	}
+	return nil
+}
+
+// renameWithUUID adds uuid before the extension of filePath and of its
+// sidecars, so movie.en.srt still goes with movie.<uuid>.mp4. acceptFile
+// skips the renamed file, it isn't uploaded again by the next run.
+func renameWithUUID(filePath string, uuid string) error {
+	companions := companionFiles(filePath)
+	ext := filepath.Ext(filePath)
+	if err := moveFile(filePath, strings.TrimSuffix(filePath, ext)+"."+uuid+ext); err != nil {
+		return err
+	}
+	base := GetFileName(filePath)
+	for _, companion := range companions {
+		name := base + "." + uuid + strings.TrimPrefix(filepath.Base(companion), base)
+		if err := moveFile(companion, filepath.Join(filepath.Dir(companion), name)); err != nil {
+			logger.LogWarning("not able to rename sidecar file", map[string]interface{}{"error": err, "file": companion})
+		}
+	}
+	return nil
+}
+
+// renamedWithUUID reports whether name was renamed by renameWithUUID.
+func renamedWithUUID(name string) bool {
+	return uuidSuffix.MatchString(strings.TrimSuffix(name, filepath.Ext(name)))
+}
+
+// companionFiles lists the sidecars, captions and images next to mediaPath
+// that belong to it: the names findSidecar, findCaptionFiles and
+// findThumbnailFile look for. concert-encore.srt belongs to
+// concert-encore.mp4, not to concert.mp4.
+func companionFiles(mediaPath string) []string {
+	entries, err := os.ReadDir(filepath.Dir(mediaPath))
+	if err != nil {
+		return nil
+	}
+	base := GetFileName(mediaPath)
+	var companions []string
+	for _, entry := range entries {
+		name := entry.Name()
+		ext := strings.ToLower(filepath.Ext(name))
+		if entry.IsDir() || !sidecarExtensions[ext] {
+			continue
+		}
+		if isCompanion(base, filepath.Base(mediaPath), strings.TrimSuffix(name, filepath.Ext(name)), ext) {
+			companions = append(companions, filepath.Join(filepath.Dir(mediaPath), name))
+		}
+	}
+	return companions
+}
+
+// isCompanion reports whether a file named stem+ext belongs to the media file
+// fileName, whose name without extension is base.
+func isCompanion(base string, fileName string, stem string, ext string) bool {
+	if stem == base {
+		return true
+	}
+	if stem == fileName {
+		// movie.mp4.json, movie.mp4.yaml
+		return ext == ".json" || ext == ".yaml" || ext == ".yml"
+	}
+	if captionExtensions[ext] && strings.HasPrefix(stem, base+".") {
+		return captionLanguage(strings.TrimPrefix(stem, base+".")) != ""
+	}
+	if imageExtensions[ext] {
+		return stem == base+"-thumb" || stem == base+"-poster" || stem == base+".thumb"
+	}
+	return false
+}
+
+// moveFile renames src to dst, copying when they are on different devices.
+// An existing dst is never overwritten.
+func moveFile(src string, dst string) error {
+	if _, err := os.Stat(dst); err == nil {
+		return fmt.Errorf("%s already exists", dst)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	in.Close()
+	return os.Remove(src)
+}
@@ -0,0 +1,98 @@
+package media
+
+import (
+	"os"
+	"path/filepath"
+	"peertubeupload/config"
+	"sort"
+	"testing"
+)
+
+func TestRenameWithUUID(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"movie.mp4", "movie.en.srt", "movie.json", "movies.mp4"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	uuid := "9c9de5e8-0a1b-4d0f-8a2e-3c1b2f4e5d6a"
+
+	if err := renameWithUUID(filepath.Join(dir, "movie.mp4"), uuid); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	want := []string{"movie." + uuid + ".en.srt", "movie." + uuid + ".json", "movie." + uuid + ".mp4", "movies.mp4"}
+	if len(names) != len(want) {
+		t.Fatalf("files = %v, want %v", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("files = %v, want %v", names, want)
+		}
+	}
+}
+
+func TestCompanionFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"concert.mp4", "concert.srt", "concert.en.srt", "concert.pt-br.vtt", "concert.json", "concert.mp4.yaml",
+		"concert.nfo", "concert.jpg", "concert-thumb.png", "concert-poster.jpg", "concert.thumb.webp",
+		"concert-encore.mp4", "concert-encore.srt", "concert-encore.json", "concert.encore.srt", "concert.2024.jpg", "concert.mp4.jpg",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var names []string
+	for _, companion := range companionFiles(filepath.Join(dir, "concert.mp4")) {
+		names = append(names, filepath.Base(companion))
+	}
+	sort.Strings(names)
+	want := []string{
+		"concert-poster.jpg", "concert-thumb.png", "concert.en.srt", "concert.jpg", "concert.json", "concert.mp4.yaml",
+		"concert.nfo", "concert.pt-br.vtt", "concert.srt", "concert.thumb.webp",
+	}
+	if len(names) != len(want) {
+		t.Fatalf("companions = %v, want %v", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("companions = %v, want %v", names, want)
+		}
+	}
+}
+
+func TestAcceptFileSkipsRenamed(t *testing.T) {
+	c := &config.Config{}
+	c.DispositionConfig.OnSuccess = DispositionRename
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"movie.mp4", true},
+		{"movie.9c9de5e8-0a1b-4d0f-8a2e-3c1b2f4e5d6a.mp4", false},
+		{"movie.2024.mp4", true},
+		{"movie.en.srt", false},
+	}
+	for _, tt := range tests {
+		if got := acceptFile(c, tt.name); got != tt.want {
+			t.Errorf("acceptFile(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	c.DispositionConfig.OnSuccess = DispositionKeep
+	if !acceptFile(c, "movie.9c9de5e8-0a1b-4d0f-8a2e-3c1b2f4e5d6a.mp4") {
+		t.Error("renamed names are only skipped with the rename disposition")
+	}
+}
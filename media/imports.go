@@ -0,0 +1,222 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"peertubeupload/apiclient"
+	"peertubeupload/config"
+	"peertubeupload/logger"
+	"peertubeupload/model"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Fields of POST /videos/imports a source is sent in.
+const (
+	importTargetURL   = "targetUrl"
+	importMagnetURI   = "magnetUri"
+	importTorrentFile = "torrentfile"
+)
+
+// defaultImportTimeout is how many minutes an import may take when
+// importConfig has no timeout. Imports of long videos over slow links can
+// take a while, so it is generous.
+const defaultImportTimeout = 120
+
+// States of a video import on PeerTube.
+const (
+	importPending    = 1
+	importSuccess    = 2
+	importFailed     = 3
+	importRejected   = 4
+	importCancelled  = 5
+	importProcessing = 6
+)
+
+// importField returns the field of POST /videos/imports that takes path, or
+// "" for a local media file that is uploaded.
+func importField(path string) string {
+	lower := strings.ToLower(path)
+	switch {
+	case strings.HasPrefix(lower, "magnet:"):
+		return importMagnetURI
+	case strings.HasPrefix(lower, "http://"), strings.HasPrefix(lower, "https://"):
+		return importTargetURL
+	case strings.HasSuffix(lower, ".torrent"):
+		return importTorrentFile
+	default:
+		return ""
+	}
+}
+
+// isRemote reports whether path is a URL or magnet link, with no local file
+// behind it.
+func isRemote(path string) bool {
+	field := importField(path)
+	return field == importTargetURL || field == importMagnetURI
+}
+
+type videoImport struct {
+	ID    int `json:"id"`
+	State struct {
+		ID    int    `json:"id"`
+		Label string `json:"label"`
+	} `json:"state"`
+	Error string            `json:"error"`
+	Video *model.VideoClass `json:"video"`
+}
+
+// ImportMedia has PeerTube fetch media.FilePath, a URL, magnet link or
+// torrent file, with the same metadata an upload would get, and waits for
+// the import to finish.
+func ImportMedia(ctx context.Context, c *config.Config, destination config.Destination, media model.Media, api *apiclient.Client) (model.Video, error) {
+	input := uploadInput(c, destination, media, nil)
+	payload, contentType, err := importPayload(input, importField(media.FilePath))
+	if err != nil {
+		logger.LogError("not able to prepare import", map[string]interface{}{"error": err, "file": media.FilePath})
+		return model.Video{}, err
+	}
+
+	var started videoImport
+	if err := sendJSON(api, "POST", api.BaseURL+"/videos/imports", contentType, payload, &started); err != nil {
+		logger.LogError("Error Importing", map[string]interface{}{"error": err, "file": media.FilePath})
+		return model.Video{}, err
+	}
+	logger.LogInfo("Import started", map[string]interface{}{"file": media.FilePath, "import": started.ID})
+
+	finished, err := waitForImport(ctx, c, api, started.ID)
+	if err != nil {
+		logger.LogError("Error Importing", map[string]interface{}{"error": err, "file": media.FilePath, "import": started.ID})
+		return model.Video{}, err
+	}
+	video := model.Video{}
+	if finished.Video != nil {
+		video.Video = *finished.Video
+	} else if started.Video != nil {
+		video.Video = *started.Video
+	}
+	return video, nil
+}
+
+// importPayload writes the attributes of input and the source as the
+// multipart form POST /videos/imports expects.
+func importPayload(input MultipartUploadHandlerHandlerInput, field string) ([]byte, string, error) {
+	payload := &bytes.Buffer{}
+	writer := multipart.NewWriter(payload)
+	if err := writeFields(writer, videoAttributes(input)); err != nil {
+		return nil, "", err
+	}
+
+	if field == importTorrentFile {
+		torrent, err := os.ReadFile(input.FileName)
+		if err != nil {
+			return nil, "", err
+		}
+		part, err := writer.CreateFormFile(field, filepath.Base(input.FileName))
+		if err != nil {
+			return nil, "", err
+		}
+		if _, err := part.Write(torrent); err != nil {
+			return nil, "", err
+		}
+	} else if err := writer.WriteField(field, input.FileName); err != nil {
+		return nil, "", err
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, "", err
+	}
+	return payload.Bytes(), writer.FormDataContentType(), nil
+}
+
+// writeFields adds fields to a multipart form, lists as repeated name[]
+// fields.
+func writeFields(writer *multipart.Writer, fields map[string]interface{}) error {
+	for name, value := range fields {
+		var err error
+		switch v := value.(type) {
+		case []string:
+			for _, item := range v {
+				if err = writer.WriteField(name+"[]", item); err != nil {
+					break
+				}
+			}
+		default:
+			err = writer.WriteField(name, fmt.Sprint(v))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitForImport polls the imports of the account every
+// importConfig.pollInterval seconds until importID succeeds, fails, or
+// importConfig.timeout minutes went by. A timeout of 0 or less waits for as
+// long as the import takes. A cancelled ctx stops waiting, the import
+// carries on on the instance.
+func waitForImport(ctx context.Context, c *config.Config, api *apiclient.Client, importID int) (videoImport, error) {
+	interval := time.Duration(c.ImportConfig.PollInterval) * time.Second
+	if interval <= 0 {
+		interval = 15 * time.Second
+	}
+	timeout := defaultImportTimeout
+	if c.ImportConfig.Timeout != nil {
+		timeout = *c.ImportConfig.Timeout
+	}
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(time.Duration(timeout) * time.Minute)
+	}
+
+	for {
+		current, err := findImport(api, importID)
+		if err != nil {
+			logger.LogWarning("not able to check the import, trying again", map[string]interface{}{"error": err, "import": importID})
+		} else {
+			switch current.State.ID {
+			case importSuccess:
+				return current, nil
+			case importFailed, importRejected, importCancelled:
+				return current, fmt.Errorf("import %s: %s", strings.ToLower(current.State.Label), current.Error)
+			}
+		}
+
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return videoImport{}, fmt.Errorf("import %d didn't finish within %d minutes", importID, timeout)
+		}
+		if err := sleepContext(ctx, interval); err != nil {
+			return videoImport{}, err
+		}
+	}
+}
+
+// findImport looks importID up among the latest imports of the account,
+// PeerTube has no endpoint for a single import.
+func findImport(api *apiclient.Client, importID int) (videoImport, error) {
+	var imports []videoImport
+	for {
+		var page struct {
+			Total int           `json:"total"`
+			Data  []videoImport `json:"data"`
+		}
+		if err := getJSON(api, api.BaseURL+"/users/me/videos/imports?sort=-createdAt&count=100&start="+strconv.Itoa(len(imports)), &page); err != nil {
+			return videoImport{}, err
+		}
+		for _, i := range page.Data {
+			if i.ID == importID {
+				return i, nil
+			}
+		}
+		imports = append(imports, page.Data...)
+		if len(page.Data) == 0 || len(imports) >= page.Total {
+			return videoImport{}, fmt.Errorf("import %d not found", importID)
+		}
+	}
+}
@@ -161,7 +161,9 @@ func GetFileName(fpath string) string {
 
 func convertToMp3(fpath string, tmpPath string) error {
 
-	cmd := exec.Command("ffmpeg", "-y", "-i", fpath, tmpPath)
+	// bitexact leaves out the encoder version, so converting the same file
+	// again gives the same bytes and an interrupted upload can resume
+	cmd := exec.Command("ffmpeg", "-y", "-i", fpath, "-fflags", "+bitexact", "-flags:a", "+bitexact", tmpPath)
 	err := cmd.Run()
 	if err != nil {
 		return err
@@ -0,0 +1,214 @@
+package media
+
+import (
+	"fmt"
+	"peertubeupload/config"
+	"peertubeupload/logger"
+	"peertubeupload/model"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PeerTube rejects an upload whose tags break these limits, so tags are
+// cleaned up before they are sent rather than failing the whole file.
+const (
+	maxTags      = 5
+	minTagLength = 2
+	maxTagLength = 30
+)
+
+// metadataColumns returns the optional metadata columns mapped in dbConfig.
+func metadataColumns(c *config.Config) []string {
+	var columns []string
+	for _, column := range []string{
+		c.DBConfig.Tags,
+		c.DBConfig.Category,
+		c.DBConfig.Licence,
+		c.DBConfig.Language,
+		c.DBConfig.NSFW,
+		c.DBConfig.Support,
+		c.DBConfig.Privacy,
+		c.DBConfig.Captions,
+		c.DBConfig.Thumbnail,
+		c.DBConfig.CreateDate,
+		c.DBConfig.Destinations,
+		c.DBConfig.Channel,
+		c.DBConfig.Playlist,
+		c.DBConfig.PlaylistPosition,
+	} {
+		if column != "" {
+			columns = append(columns, column)
+		}
+	}
+	return columns
+}
+
+// mediaFromRow maps a row read by gatherPathsFromDB to the media to upload.
+func mediaFromRow(c *config.Config, row map[string]interface{}) model.Media {
+	media := model.Media{
+		Title:       columnString(row, c.DBConfig.Title),
+		Description: columnString(row, c.DBConfig.Description),
+		FilePath:    columnString(row, c.DBConfig.FilePath),
+		Tags:        normalizeTags(strings.Split(columnString(row, c.DBConfig.Tags), ",")),
+		Category:    columnInt(row, c.DBConfig.Category),
+		Licence:     columnInt(row, c.DBConfig.Licence),
+		Language:    columnString(row, c.DBConfig.Language),
+		NSFW:        columnBool(row, c.DBConfig.NSFW),
+		Support:     columnString(row, c.DBConfig.Support),
+		Privacy:     columnInt(row, c.DBConfig.Privacy),
+		// a relative path is taken as it is, like the file path column
+		ThumbnailPath:    columnString(row, c.DBConfig.Thumbnail),
+		Destinations:     splitList(columnString(row, c.DBConfig.Destinations)),
+		Channel:          columnString(row, c.DBConfig.Channel),
+		Playlist:         columnString(row, c.DBConfig.Playlist),
+		PlaylistPosition: columnInt(row, c.DBConfig.PlaylistPosition),
+	}
+	if media.Channel == "" {
+		media.Channel = routeChannel(c, media.FilePath)
+		media.ChannelRouted = true
+	}
+	if media.Playlist == "" {
+		media.Playlist = routePlaylist(c, media.FilePath)
+		media.PlaylistRouted = true
+	}
+	if date := columnTime(row, c.DBConfig.CreateDate); !date.IsZero() {
+		media.DateCandidates = map[string]time.Time{DateSourceDB: date}
+	}
+	if c.CaptionConfig.Enabled {
+		if !isRemote(media.FilePath) {
+			media.Captions = findCaptionFiles(media.FilePath, c.CaptionConfig.DefaultLanguage)
+		}
+		media.Captions = append(media.Captions, captionsFromColumn(columnString(row, c.DBConfig.Captions), c.CaptionConfig.DefaultLanguage)...)
+	}
+	return media
+}
+
+// mediaFromFolder builds the media for a file found by gatherPathsFromFolder,
+// filled with the defaults from folderConfig and then with its sidecar file
+// if there is one.
+func mediaFromFolder(c *config.Config, path string) model.Media {
+	media := model.Media{
+		Title:          GetFileName(path),
+		Description:    c.FolderConfig.Description,
+		FilePath:       path,
+		Tags:           normalizeTags(c.FolderConfig.Tags),
+		Category:       c.FolderConfig.Category,
+		Licence:        c.FolderConfig.Licence,
+		Language:       c.FolderConfig.Language,
+		NSFW:           c.FolderConfig.NSFW,
+		Support:        c.FolderConfig.Support,
+		Channel:        routeChannel(c, path),
+		ChannelRouted:  true,
+		Playlist:       routePlaylist(c, path),
+		PlaylistRouted: true,
+	}
+	if c.CaptionConfig.Enabled {
+		media.Captions = findCaptionFiles(path, c.CaptionConfig.DefaultLanguage)
+	}
+
+	sidecar, sidecarPath, err := findSidecar(path)
+	if err != nil {
+		logger.LogWarning("not able to read sidecar, using defaults", map[string]interface{}{"error": err, "file": path})
+	} else if sidecar != nil {
+		applySidecar(&media, sidecar, sidecarPath)
+	}
+	return media
+}
+
+// splitList splits a comma separated column value, dropping empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func columnString(row map[string]interface{}, column string) string {
+	if column == "" {
+		return ""
+	}
+	return valueString(row[column])
+}
+
+// valueString turns a value scanned by database/sql into trimmed text.
+func valueString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return strings.TrimSpace(string(v))
+	default:
+		return strings.TrimSpace(fmt.Sprintf("%v", v))
+	}
+}
+
+func columnInt(row map[string]interface{}, column string) int {
+	value := columnString(row, column)
+	if value == "" {
+		return 0
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		logger.LogWarning("column is not a number, ignoring it", map[string]interface{}{"column": column, "value": value})
+		return 0
+	}
+	return i
+}
+
+// columnTime reads a date column, either a date type the driver converts or
+// text in one of the formats parseDate knows.
+func columnTime(row map[string]interface{}, column string) time.Time {
+	if column == "" {
+		return time.Time{}
+	}
+	if t, ok := row[column].(time.Time); ok {
+		return t
+	}
+	value := columnString(row, column)
+	if value == "" {
+		return time.Time{}
+	}
+	t, err := parseDate(value)
+	if err != nil {
+		logger.LogWarning("column is not a date, ignoring it", map[string]interface{}{"column": column, "value": value})
+		return time.Time{}
+	}
+	return t
+}
+
+func columnBool(row map[string]interface{}, column string) bool {
+	switch strings.ToLower(columnString(row, column)) {
+	case "1", "t", "true", "y", "yes":
+		return true
+	default:
+		return false
+	}
+}
+
+// normalizeTags trims and de-duplicates tags and drops the ones PeerTube
+// would refuse.
+func normalizeTags(tags []string) []string {
+	var result []string
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[strings.ToLower(tag)] {
+			continue
+		}
+		if len([]rune(tag)) < minTagLength || len([]rune(tag)) > maxTagLength {
+			logger.LogWarning("tag length is not accepted by peertube, skipping tag", map[string]interface{}{"tag": tag})
+			continue
+		}
+		if len(result) == maxTags {
+			logger.LogWarning("peertube accepts only 5 tags, dropping the rest", map[string]interface{}{"tags": tags})
+			break
+		}
+		seen[strings.ToLower(tag)] = true
+		result = append(result, tag)
+	}
+	return result
+}
@@ -0,0 +1,79 @@
+package media
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeTags(t *testing.T) {
+	tests := []struct {
+		name string
+		tags []string
+		want []string
+	}{
+		{"trimmed", []string{" music ", "live"}, []string{"music", "live"}},
+		{"duplicates ignore case", []string{"Music", "music", "MUSIC"}, []string{"Music"}},
+		{"empty dropped", []string{"", "  ", "news"}, []string{"news"}},
+		{"too short", []string{"a", "ok"}, []string{"ok"}},
+		{"too long", []string{"abcdefghijklmnopqrstuvwxyz12345", "fine"}, []string{"fine"}},
+		{"at most five", []string{"one", "two", "three", "four", "five", "six"}, []string{"one", "two", "three", "four", "five"}},
+		{"none", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalizeTags(tt.tags); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("normalizeTags(%q) = %q, want %q", tt.tags, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUploadSendsMetadata(t *testing.T) {
+	fake := &resumableServer{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	input := testUpload(t, server, writeTestFile(t, "0123456789"), nil)
+	input.DescriptionText = "Live at the park"
+	input.Tags = []string{"music", "live"}
+	input.Category = 1
+	input.Licence = 2
+	input.Language = "en"
+	input.NSFW = true
+	input.SupportText = "Thanks for watching"
+	if _, err := upload(server, input); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]interface{}{
+		"description": "Live at the park",
+		"tags":        []interface{}{"music", "live"},
+		"category":    float64(1),
+		"licence":     float64(2),
+		"language":    "en",
+		"nsfw":        true,
+		"support":     "Thanks for watching",
+	}
+	for field, value := range want {
+		if !reflect.DeepEqual(fake.initialized[field], value) {
+			t.Errorf("%s = %v, want %v", field, fake.initialized[field], value)
+		}
+	}
+}
+
+func TestUploadLeavesOutEmptyMetadata(t *testing.T) {
+	fake := &resumableServer{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	if _, err := upload(server, testUpload(t, server, writeTestFile(t, "0123456789"), nil)); err != nil {
+		t.Fatal(err)
+	}
+	// PeerTube rejects empty values of these fields
+	for _, field := range []string{"description", "tags", "category", "licence", "language", "support"} {
+		if value, ok := fake.initialized[field]; ok {
+			t.Errorf("%s = %v was sent, want it left out", field, value)
+		}
+	}
+}
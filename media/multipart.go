@@ -2,14 +2,19 @@ package media
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"path/filepath"
+	"peertubeupload/apiclient"
 	"peertubeupload/config"
 	"peertubeupload/logger"
 	"peertubeupload/model"
+	"peertubeupload/state"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -27,90 +32,102 @@ type OauthClientsLocal struct {
 	Client_secret string
 }
 type MultipartUploadHandlerHandlerInput struct {
-	Hostname              string
-	Username              string
-	Password              string
-	ContentType           string
-	ChannelID             int
-	File                  *VideoFileReader
-	FileName              string
+	// Destination is the name of the destination the upload goes to
+	Destination string
+	Hostname    string
+	Username    string
+	Password    string
+	ContentType string
+	ChannelID   int
+	File        *VideoFileReader
+	FileName    string
+	// SourceFile is the file the session is keyed and identified by, the
+	// original when FileName is an mp3 converted from it
+	SourceFile            string
 	DisplayName           string
 	Privacy               int8
 	Category              int
 	CommentsEnabled       bool
 	DescriptionText       string
 	DownloadEnabled       bool
+	WaitTranscoding       bool
 	Language              string
 	Licence               int
 	NSFW                  bool
 	SupportText           string
 	Tags                  []string
 	OriginallyPublishedAt string
+	State                 *state.Store
+	// CancelOnShutdown deletes the resumable session when ctx is cancelled
+	// mid-upload instead of keeping it for the next run.
+	CancelOnShutdown bool
+	Retry            RetryPolicy
+	// ReplaceVideo swaps the file of this existing video instead of creating
+	// a new one
+	ReplaceVideo *model.VideoClass
 }
 
-var maxRetries = 3
-
-const delayBetweenRetries = 15 * time.Second
-
-func MultipartUploadHandler(input MultipartUploadHandlerHandlerInput, token string) (video model.Video, err error) {
+// MultipartUploadHandler uploads input.File through a resumable session.
+// Cancelling ctx stops the upload after the request in flight, the session
+// is then kept in input.State so the next run resumes it, or deleted on the
+// server with input.CancelOnShutdown. Requests go through api, which takes
+// care of a token expiring in the middle of the upload.
+func MultipartUploadHandler(ctx context.Context, input MultipartUploadHandlerHandlerInput, api *apiclient.Client) (video model.Video, err error) {
 
 	client := &http.Client{}
-	initializeUrl := fmt.Sprintf("%s/api/v1/videos/upload-resumable", input.Hostname)
-	initializePayload := map[string]interface{}{
-		"channelId":             input.ChannelID,
-		"filename":              input.FileName,
-		"name":                  input.DisplayName,
-		"commentsEnabled":       input.CommentsEnabled,
-		"downloadEnabled":       input.DownloadEnabled,
-		"privacy":               input.Privacy,
-		"waitTranscoding":       true,
-		"originallyPublishedAt": input.OriginallyPublishedAt,
+	source := input.SourceFile
+	if source == "" {
+		source = input.FileName
 	}
-	initializePayloadBytes, err := json.Marshal(initializePayload)
-	if err != nil {
-		return video, err
-
-	}
-	initialize, err := http.NewRequest("POST", initializeUrl, bytes.NewReader(initializePayloadBytes))
-	if err != nil {
-		return video, err
+	key := state.Key(input.Destination, input.Hostname, source)
+	if input.ReplaceVideo != nil {
+		// never resume a new upload of the file as a replacement, or the
+		// other way around
+		key += "|replace|" + videoID(*input.ReplaceVideo)
 	}
 
-	initialize.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
-	initialize.Header.Add("X-Upload-Content-Length", fmt.Sprintf("%d", input.File.TotalBytes))
-	initialize.Header.Add("X-Upload-Content-Type", input.ContentType)
-	initialize.Header.Add("Content-Type", "application/json")
+	var session state.Session
+	if input.State != nil {
+		session, err = state.Identify(source)
+		if err != nil {
+			return video, err
+		}
+		session.Hostname = input.Hostname
+	}
 
-	resp, err := client.Do(initialize)
+	uploadLocation, video, done, err := resumeSession(ctx, client, api, input, key, session)
 	if err != nil {
 		return video, err
 	}
-
-	if resp.StatusCode != 201 {
-		logger.LogInfo("initialize api call returned status code ", map[string]interface{}{"status code": resp.StatusCode})
-
-		_, err2 := io.ReadAll(resp.Body)
-		if err2 != nil {
-			return video, err2
+	if done {
+		logger.LogInfo("Server already holds the whole file, upload finished in a previous run", map[string]interface{}{"file": input.FileName})
+		if err := input.State.Delete(key); err != nil {
+			logger.LogWarning("not able to clear upload state", map[string]interface{}{"error": err, "file": input.FileName})
+		}
+		return video, nil
+	}
+	if uploadLocation == "" {
+		uploadLocation, err = initializeSession(ctx, client, api, input)
+		if err != nil {
+			return video, err
+		}
+		session.UploadURL = uploadLocation
+		session.LastByte = -1
+		if err := input.State.Put(key, session); err != nil {
+			logger.LogWarning("not able to save upload state, this upload can't be resumed", map[string]interface{}{"error": err, "file": input.FileName})
 		}
-		defer resp.Body.Close()
-
-		return video, fmt.Errorf("returned non 201 status %s", resp.Status)
 	}
+	session.UploadURL = uploadLocation
 
-	defer resp.Body.Close()
-	uploadLocation := resp.Header.Get("Location")
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			interruptSession(api, input, key, uploadLocation)
+		}
+	}()
 
-	if strings.HasPrefix(uploadLocation, "//") {
-		uploadLocation = "http:" + uploadLocation
-	} else if strings.HasPrefix(uploadLocation, "https://") {
-		// Do nothing, continue processing
-	} else {
-		logger.LogWarning("Warning: received an upload location that doesn't begin with \"//\" or \"https://\"", map[string]interface{}{"file": input.FileName})
-		return video, fmt.Errorf("invalid upload location URL: %s", uploadLocation)
-	}
-	logger.LogInfo("Upload Location", map[string]interface{}{"location": uploadLocation})
+	policy := input.Retry.withDefaults()
 
+chunks:
 	for {
 		chunk, err := input.File.GetNextChunk()
 		if err != nil {
@@ -121,33 +138,75 @@ func MultipartUploadHandler(input MultipartUploadHandlerHandlerInput, token stri
 			break
 		}
 
-		for {
-			up, err := http.NewRequest("PUT", uploadLocation, bytes.NewReader(chunk.Bytes))
-			if err != nil {
-
-				return video, err
-
-			}
-
-			up.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
-			up.Header.Add("Content-Length", fmt.Sprintf("%d", chunk.Length))
-			up.Header.Add("Content-Range", chunk.RangeHeader)
-
+		// attempts are counted per chunk, so a flaky connection early on
+		// doesn't leave the rest of the file without retries
+		for attempt := 1; ; attempt++ {
 			logger.LogInfo("upload details", map[string]interface{}{"MinBye": chunk.MinByte, "MaxByte": chunk.MaxByte, "length": chunk.Length, "RangeHeader": chunk.RangeHeader})
-			resp, err := client.Do(up)
+			resp, err := api.DoWith(client, func() (*http.Request, error) {
+				// Rewind in case a previous attempt already consumed part of the chunk
+				if _, err := chunk.Reader.Seek(0, io.SeekStart); err != nil {
+					return nil, err
+				}
+				up, err := http.NewRequestWithContext(ctx, "PUT", uploadLocation, chunk.Reader)
+				if err != nil {
+					return nil, err
+				}
+				// http.NewRequest can't size a SectionReader, without this the body
+				// would be sent chunked and the server would reject the range
+				up.ContentLength = chunk.Length
+				up.Header.Add("Content-Range", chunk.RangeHeader)
+				return up, nil
+			})
 			if err != nil {
-				return video, err
+				if ctx.Err() != nil {
+					return video, ctx.Err()
+				}
+				if attempt >= policy.Attempts {
+					return video, fmt.Errorf("chunk %s failed after %d attempts: %w", chunk.RangeHeader, attempt, err)
+				}
+				wait := policy.backoff(attempt)
+				logger.LogWarning("network error while uploading chunk, will retry", map[string]interface{}{"error": err, "file": input.FileName, "attempt": attempt, "wait": wait.String()})
+				if err := sleepContext(ctx, wait); err != nil {
+					return video, err
+				}
+
+				// The server may have stored part of the chunk before the
+				// connection dropped, ask where to continue from
+				status, lastByte, body, err := queryRange(ctx, client, api, uploadLocation, input.File.TotalBytes)
+				if err != nil {
+					continue
+				}
+				switch status {
+				case 200, 201, 204:
+					video, err = finishedVideo(input, body)
+					if err != nil {
+						return video, err
+					}
+					break chunks
+				case 308:
+					if lastByte < int64(chunk.MinByte)-1 || lastByte > int64(chunk.MaxByte) {
+						continue
+					}
+					if err := input.File.SeekTo(VideoFileByteCounter(lastByte + 1)); err != nil {
+						return video, err
+					}
+					session.LastByte = lastByte
+					if err := input.State.Put(key, session); err != nil {
+						logger.LogWarning("not able to save upload state", map[string]interface{}{"error": err, "file": input.FileName})
+					}
+					continue chunks
+				}
+				continue
 			}
-			// logger.LogInfo(resp.Status, nil)
 
 			logger.LogInfo("Received response", map[string]interface{}{"uploadLocation": uploadLocation, "statusCode": resp.StatusCode})
 
-			defer resp.Body.Close()
 			body, err2 := io.ReadAll(resp.Body)
+			resp.Body.Close()
 			if err2 != nil {
 				return video, err2
 			}
-			if len(body) != 0 {
+			if len(body) != 0 && (resp.StatusCode == 200 || resp.StatusCode == 308) {
 				video, err = model.UnmarshalVideo(body)
 
 				if err != nil {
@@ -157,45 +216,294 @@ func MultipartUploadHandler(input MultipartUploadHandlerHandlerInput, token stri
 
 			}
 
-			fmt.Println(resp.StatusCode)
-			if resp.StatusCode == 308 || resp.StatusCode == 200 {
+			if resp.StatusCode == 308 {
+				lastByte := int64(chunk.MaxByte)
+				if ranged, ok := parseRangeHeader(resp.Header.Get("Range")); ok {
+					lastByte = ranged
+				}
+				// the server may have kept only part of the chunk, the next
+				// one starts right after what it holds. When it kept none of
+				// it the chunk is retried below
+				if lastByte >= int64(chunk.MinByte) {
+					if err := input.File.SeekTo(VideoFileByteCounter(lastByte + 1)); err != nil {
+						return video, err
+					}
+					session.LastByte = lastByte
+					if err := input.State.Put(key, session); err != nil {
+						logger.LogWarning("not able to save upload state", map[string]interface{}{"error": err, "file": input.FileName})
+					}
+					break
+				}
+			} else if resp.StatusCode == 200 {
 				break
-			} else {
-				logger.LogWarning("Status code other than 308, 200 or 429 received. Will retry.", nil)
-				time.Sleep(delayBetweenRetries)
+			} else if resp.StatusCode == 204 {
+				// a replacement ends with no body
+				video, err = finishedVideo(input, body)
+				if err != nil {
+					return video, err
+				}
+				break
+			}
+
+			if resp.StatusCode != 308 && !retryableStatus(resp.StatusCode) {
+				return video, fmt.Errorf("chunk %s returned %s: %s", chunk.RangeHeader, resp.Status, body)
 			}
-			maxRetries--
-			if maxRetries <= 0 {
-				logger.LogError("Max retry attempts reached", nil)
-				return video, fmt.Errorf("max retry attempts reached")
+			if attempt >= policy.Attempts {
+				logger.LogError("Max retry attempts reached", map[string]interface{}{"file": input.FileName, "statusCode": resp.StatusCode})
+				return video, fmt.Errorf("chunk %s failed after %d attempts: %s", chunk.RangeHeader, attempt, resp.Status)
+			}
+			wait := policy.backoff(attempt)
+			if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+				wait = retryAfter
+			}
+			logger.LogWarning("server asked to retry the chunk", map[string]interface{}{"file": input.FileName, "statusCode": resp.StatusCode, "attempt": attempt, "wait": wait.String()})
+			if err := sleepContext(ctx, wait); err != nil {
+				return video, err
 			}
 		}
 	}
+
+	if err := input.State.Delete(key); err != nil {
+		logger.LogWarning("not able to clear upload state", map[string]interface{}{"error": err, "file": input.FileName})
+	}
 	return video, nil
 }
-func UploadMediaInChunksOS(c *config.Config, media model.Media, token string) (model.Video, error) {
 
-	videoFile := &VideoFileReader{}
+// initializeSession opens a new resumable upload and returns its location.
+func initializeSession(ctx context.Context, client *http.Client, api *apiclient.Client, input MultipartUploadHandlerHandlerInput) (string, error) {
+	initializeUrl := fmt.Sprintf("%s/api/v1/videos/upload-resumable", input.Hostname)
+	initializePayload := videoAttributes(input)
+	if input.ReplaceVideo != nil {
+		// the metadata of the video stays as it is
+		initializeUrl = fmt.Sprintf("%s/api/v1/videos/%s/source/replace-resumable", input.Hostname, videoID(*input.ReplaceVideo))
+		initializePayload = map[string]interface{}{}
+	}
+	initializePayload["filename"] = input.FileName
+	initializePayloadBytes, err := json.Marshal(initializePayload)
+	if err != nil {
+		return "", err
 
-	// Create an instance of MultipartUploadHandlerHandlerInput
-	input := MultipartUploadHandlerHandlerInput{
-		Hostname:              fmt.Sprintf("%s:%s", c.APIConfig.URL, c.APIConfig.Port),
-		Username:              c.APIConfig.Username,
-		Password:              c.APIConfig.Password,
-		ChannelID:             c.APIConfig.ChannelID, // replace with your channel ID
-		File:                  videoFile,
-		FileName:              media.FilePath,
-		DisplayName:           media.Title,
-		Privacy:               int8(c.APIConfig.Privacy), // replace with your privacy setting
-		CommentsEnabled:       c.APIConfig.CommentsEnabled,
-		DownloadEnabled:       c.APIConfig.DownloadEnabled,
-		OriginallyPublishedAt: media.CreateDate.Format("2006-01-02 15:04:05"),
 	}
+	resp, err := api.DoWith(client, func() (*http.Request, error) {
+		initialize, err := http.NewRequestWithContext(ctx, "POST", initializeUrl, bytes.NewReader(initializePayloadBytes))
+		if err != nil {
+			return nil, err
+		}
+		initialize.Header.Add("X-Upload-Content-Length", fmt.Sprintf("%d", input.File.TotalBytes))
+		initialize.Header.Add("X-Upload-Content-Type", input.ContentType)
+		initialize.Header.Add("Content-Type", "application/json")
+		return initialize, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 201 {
+		logger.LogInfo("initialize api call returned status code ", map[string]interface{}{"status code": resp.StatusCode})
+
+		body, err2 := io.ReadAll(resp.Body)
+		if err2 != nil {
+			return "", err2
+		}
+
+		return "", fmt.Errorf("returned non 201 status %s: %s", resp.Status, body)
+	}
+
+	uploadLocation := resp.Header.Get("Location")
+
+	if strings.HasPrefix(uploadLocation, "//") {
+		uploadLocation = "http:" + uploadLocation
+	} else if strings.HasPrefix(uploadLocation, "https://") {
+		// Do nothing, continue processing
+	} else {
+		logger.LogWarning("Warning: received an upload location that doesn't begin with \"//\" or \"https://\"", map[string]interface{}{"file": input.FileName})
+		return "", fmt.Errorf("invalid upload location URL: %s", uploadLocation)
+	}
+	logger.LogInfo("Upload Location", map[string]interface{}{"location": uploadLocation})
+
+	return uploadLocation, nil
+}
+
+// finishedVideo reads the video from the answer to the last chunk. A
+// replacement gets no body, the video is the one replaced.
+func finishedVideo(input MultipartUploadHandlerHandlerInput, body []byte) (model.Video, error) {
+	if input.ReplaceVideo != nil && len(bytes.TrimSpace(body)) == 0 {
+		return model.Video{Video: *input.ReplaceVideo}, nil
+	}
+	return model.UnmarshalVideo(body)
+}
+
+// videoAttributes maps input to the fields PeerTube takes for a new video,
+// whether it is uploaded or imported.
+func videoAttributes(input MultipartUploadHandlerHandlerInput) map[string]interface{} {
+	attributes := map[string]interface{}{
+		"channelId":             input.ChannelID,
+		"name":                  input.DisplayName,
+		"commentsEnabled":       input.CommentsEnabled,
+		"downloadEnabled":       input.DownloadEnabled,
+		"privacy":               input.Privacy,
+		"waitTranscoding":       input.WaitTranscoding,
+		"originallyPublishedAt": input.OriginallyPublishedAt,
+		"nsfw":                  input.NSFW,
+	}
+	// PeerTube validates every field it receives, so optional ones are only
+	// sent when they have a value
+	if input.DescriptionText != "" {
+		attributes["description"] = input.DescriptionText
+	}
+	if len(input.Tags) > 0 {
+		attributes["tags"] = input.Tags
+	}
+	if input.Category > 0 {
+		attributes["category"] = input.Category
+	}
+	if input.Licence > 0 {
+		attributes["licence"] = input.Licence
+	}
+	if input.Language != "" {
+		attributes["language"] = input.Language
+	}
+	if input.SupportText != "" {
+		attributes["support"] = input.SupportText
+	}
+	return attributes
+}
+
+// resumeSession looks for a saved session of this file and asks the server how
+// much of it was received, moving the file reader to that offset. An empty
+// location means there is nothing to resume and a new session is needed; done
+// means the server already has the whole file and video is the result.
+func resumeSession(ctx context.Context, client *http.Client, api *apiclient.Client, input MultipartUploadHandlerHandlerInput, key string, current state.Session) (uploadLocation string, video model.Video, done bool, err error) {
+	saved, ok := input.State.Get(key)
+	if !ok {
+		return "", video, false, nil
+	}
+	if !saved.SameFile(current) {
+		logger.LogWarning("file changed since the last attempt, starting a new upload", map[string]interface{}{"file": input.FileName})
+		return "", video, false, input.State.Delete(key)
+	}
+
+	status, lastByte, body, err := queryRange(ctx, client, api, saved.UploadURL, input.File.TotalBytes)
+	if err != nil {
+		return "", video, false, err
+	}
+
+	switch status {
+	case 200, 201, 204:
+		video, err = finishedVideo(input, body)
+		return "", video, err == nil, err
+	case 308:
+		if err := input.File.SeekTo(VideoFileByteCounter(lastByte + 1)); err != nil {
+			return "", video, false, err
+		}
+		logger.LogInfo("Resuming upload", map[string]interface{}{"file": input.FileName, "offset": lastByte + 1, "total": input.File.TotalBytes})
+		return saved.UploadURL, video, false, nil
+	default:
+		logger.LogWarning("saved upload session is no longer valid, starting a new upload", map[string]interface{}{"file": input.FileName, "statusCode": status})
+		return "", video, false, input.State.Delete(key)
+	}
+}
+
+// queryRange asks the server how much of the upload at uploadLocation it
+// holds. It answers 308 with the last byte received, -1 if none, or 200 with
+// the video in body once it has the whole file.
+func queryRange(ctx context.Context, client *http.Client, api *apiclient.Client, uploadLocation string, total VideoFileByteCounter) (status int, lastByte int64, body []byte, err error) {
+	resp, err := api.DoWith(client, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "PUT", uploadLocation, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Add("Content-Range", fmt.Sprintf("bytes */%d", total))
+		req.ContentLength = 0
+		return req, nil
+	})
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	defer resp.Body.Close()
+	body, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	lastByte, ok := parseRangeHeader(resp.Header.Get("Range"))
+	if !ok {
+		lastByte = -1
+	}
+	return resp.StatusCode, lastByte, body, nil
+}
+
+// interruptSession handles an upload stopped by a shutdown. By default the
+// session stays in the state file, where the last acknowledged byte was
+// saved after every chunk, so the next run resumes it. With
+// cancelOnShutdown the session is deleted on the server instead, so no
+// half uploaded file is left behind.
+func interruptSession(api *apiclient.Client, input MultipartUploadHandlerHandlerInput, key string, uploadLocation string) {
+	if !input.CancelOnShutdown {
+		logger.LogWarning("upload interrupted, it will resume on the next run", map[string]interface{}{"file": input.FileName, "resumable": input.State != nil})
+		return
+	}
+
+	// ctx is already cancelled, the DELETE gets its own short deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	resp, err := api.Do(func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "DELETE", uploadLocation, nil)
+	})
+	if err != nil {
+		logger.LogError("not able to cancel upload session", map[string]interface{}{"error": err, "file": input.FileName})
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		logger.LogError("not able to cancel upload session", map[string]interface{}{"statusCode": resp.StatusCode, "file": input.FileName})
+		return
+	}
+	if err := input.State.Delete(key); err != nil {
+		logger.LogWarning("not able to clear upload state", map[string]interface{}{"error": err, "file": input.FileName})
+	}
+	logger.LogInfo("Upload cancelled on the server", map[string]interface{}{"file": input.FileName})
+}
+
+// parseRangeHeader reads the last received byte out of a "bytes=0-1234" header.
+func parseRangeHeader(header string) (int64, bool) {
+	_, span, found := strings.Cut(header, "=")
+	if !found {
+		return 0, false
+	}
+	_, last, found := strings.Cut(span, "-")
+	if !found {
+		return 0, false
+	}
+	lastByte, err := strconv.ParseInt(strings.TrimSpace(last), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return lastByte, true
+}
+
+func UploadMediaInChunksOS(ctx context.Context, c *config.Config, destination config.Destination, media model.Media, api *apiclient.Client, store *state.Store) (model.Video, error) {
+	return uploadFile(ctx, c, uploadInput(c, destination, media, store), api)
+}
+
+// ReplaceMediaInChunksOS swaps the file of video for media.FilePath through
+// a resumable replacement, the video keeps its uuid, views and comments.
+func ReplaceMediaInChunksOS(ctx context.Context, c *config.Config, destination config.Destination, media model.Media, video model.VideoClass, api *apiclient.Client, store *state.Store) (model.Video, error) {
+	input := uploadInput(c, destination, media, store)
+	input.ReplaceVideo = &video
+	return uploadFile(ctx, c, input, api)
+}
+
+// uploadFile opens input.FileName and sends it with MultipartUploadHandler.
+func uploadFile(ctx context.Context, c *config.Config, input MultipartUploadHandlerHandlerInput, api *apiclient.Client) (model.Video, error) {
 	var err error
-	input.File, err = GetVideoFileReader(input.FileName, VideoChunkSize)
+	input.File, err = GetVideoFileReader(input.FileName, VideoFileByteCounter(c.ProccessConfig.ChunkSizeMB)*1024*1024)
 	if err != nil {
-		panic(err)
+		logger.LogError("not able to open file for upload", map[string]interface{}{"error": err, "file": input.FileName})
+		return model.Video{}, err
 	}
+	defer input.File.Close()
 	f, err := os.Open(input.FileName)
 	if err != nil {
 
@@ -209,7 +517,7 @@ func UploadMediaInChunksOS(c *config.Config, media model.Media, token string) (m
 	}
 
 	// Call the function
-	video, err := MultipartUploadHandler(input, token)
+	video, err := MultipartUploadHandler(ctx, input, api)
 
 	if err != nil {
 		logger.LogError("Error Uploading", map[string]interface{}{"error": err, "file": input.FileName})
@@ -218,3 +526,67 @@ func UploadMediaInChunksOS(c *config.Config, media model.Media, token string) (m
 
 	return video, nil
 }
+
+// audioAsMp3 converts an audio only file that isn't an mp3 yet into a
+// temporary mp3 for loadType.convertAudioToMp3. It returns "" for anything
+// else, which is uploaded as it is, and for a file ffprobe can't read.
+func audioAsMp3(c *config.Config, filePath string) (string, error) {
+	if strings.EqualFold(filepath.Ext(filePath), ".mp3") {
+		return "", nil
+	}
+	metadata, err := getMetaData(filePath)
+	if err != nil {
+		logger.LogWarning("not able to probe the file, uploading it without conversion", map[string]interface{}{"error": err, "file": filePath})
+		return "", nil
+	}
+	if isVideo, isAudio := streamKinds(metadata); isVideo || !isAudio {
+		return "", nil
+	}
+
+	out, err := tempFilePath(c, GetFileName(filePath)+".*.mp3")
+	if err != nil {
+		return "", err
+	}
+	if err := convertToMp3(filePath, out); err != nil {
+		os.Remove(out)
+		return "", err
+	}
+	return out, nil
+}
+
+// uploadInput maps media and the settings of destination to the input of an
+// upload, without the file itself.
+func uploadInput(c *config.Config, destination config.Destination, media model.Media, store *state.Store) MultipartUploadHandlerHandlerInput {
+	input := MultipartUploadHandlerHandlerInput{
+		Destination:           destination.Name,
+		Hostname:              destination.Hostname(),
+		Username:              destination.Username,
+		Password:              destination.Password,
+		ChannelID:             destination.ChannelID,
+		FileName:              media.FilePath,
+		SourceFile:            media.FilePath,
+		DisplayName:           media.Title,
+		Privacy:               int8(destination.Privacy),
+		CommentsEnabled:       destination.CommentsEnabled,
+		DownloadEnabled:       destination.DownloadEnabled,
+		WaitTranscoding:       destination.WaitTranscoding,
+		DescriptionText:       media.Description,
+		Tags:                  media.Tags,
+		Category:              media.Category,
+		Licence:               media.Licence,
+		Language:              media.Language,
+		NSFW:                  media.NSFW,
+		SupportText:           media.Support,
+		OriginallyPublishedAt: media.CreateDate.Format(time.RFC3339),
+		State:                 store,
+		CancelOnShutdown:      c.ProccessConfig.CancelOnShutdown,
+		Retry:                 RetryPolicyFromConfig(c),
+	}
+	if media.Privacy > 0 {
+		input.Privacy = int8(media.Privacy)
+	}
+	if media.ConvertedPath != "" {
+		input.FileName = media.ConvertedPath
+	}
+	return input
+}
@@ -0,0 +1,182 @@
+package media
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"peertubeupload/apiclient"
+	"peertubeupload/login"
+	"peertubeupload/model"
+	"peertubeupload/state"
+	"sync"
+	"testing"
+)
+
+func TestParseRangeHeader(t *testing.T) {
+	tests := []struct {
+		header string
+		want   int64
+		wantOK bool
+	}{
+		{"bytes=0-1234", 1234, true},
+		{"bytes=0-0", 0, true},
+		{"bytes=0- 99", 99, true},
+		{"", 0, false},
+		{"bytes=0", 0, false},
+		{"0-1234", 0, false},
+		{"bytes=0-abc", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseRangeHeader(tt.header)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("parseRangeHeader(%q) = %d, %v, want %d, %v", tt.header, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+// resumableServer is a PeerTube resumable upload endpoint that keeps at most
+// keep bytes of every chunk. A chunk that doesn't start right after the bytes
+// it holds is refused.
+type resumableServer struct {
+	mutex       sync.Mutex
+	keep        int
+	received    []byte
+	sessions    int
+	initialized map[string]interface{}
+}
+
+func (s *resumableServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/api/v1/videos/upload-resumable":
+		s.sessions++
+		json.NewDecoder(r.Body).Decode(&s.initialized)
+		w.Header().Set("Location", "//"+r.Host+"/api/v1/videos/upload-resumable?upload_id=1")
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "PUT" && r.URL.Path == "/api/v1/videos/upload-resumable":
+		var start, end, total int
+		if _, err := fmt.Sscanf(r.Header.Get("Content-Range"), "bytes */%d", &total); err == nil {
+			s.status(w, total)
+			return
+		}
+		if _, err := fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total); err != nil || start != len(s.received) {
+			http.Error(w, "unexpected range "+r.Header.Get("Content-Range"), http.StatusConflict)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if s.keep > 0 && len(body) > s.keep {
+			body = body[:s.keep]
+		}
+		s.received = append(s.received, body...)
+		s.status(w, total)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *resumableServer) status(w http.ResponseWriter, total int) {
+	if len(s.received) >= total {
+		fmt.Fprint(w, `{"video":{"id":1,"uuid":"uploaded"}}`)
+		return
+	}
+	if len(s.received) > 0 {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(s.received)-1))
+	}
+	w.WriteHeader(http.StatusPermanentRedirect)
+}
+
+func writeTestFile(t *testing.T, content string) string {
+	filePath := filepath.Join(t.TempDir(), "movie.mp4")
+	if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filePath
+}
+
+// testUpload describes the upload of filePath to server in chunks of 4 bytes.
+func testUpload(t *testing.T, server *httptest.Server, filePath string, store *state.Store) MultipartUploadHandlerHandlerInput {
+	file, err := GetVideoFileReader(filePath, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+	return MultipartUploadHandlerHandlerInput{
+		Destination: "main",
+		Hostname:    server.URL,
+		File:        file,
+		FileName:    filePath,
+		State:       store,
+	}
+}
+
+func upload(server *httptest.Server, input MultipartUploadHandlerHandlerInput) (model.Video, error) {
+	api := apiclient.New(server.Client(), &login.LoginManager{}, nil, server.URL+"/api/v1", "alice", "")
+	return MultipartUploadHandler(context.Background(), input, api)
+}
+
+func TestMultipartUploadResumesSession(t *testing.T) {
+	content := "0123456789"
+	filePath := writeTestFile(t, content)
+	// an earlier run got the first six bytes through
+	fake := &resumableServer{received: []byte(content[:6])}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	store, err := state.Open(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := state.Identify(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Hostname = server.URL
+	session.UploadURL = server.URL + "/api/v1/videos/upload-resumable?upload_id=1"
+	session.LastByte = 5
+	key := state.Key("main", server.URL, filePath)
+	if err := store.Put(key, session); err != nil {
+		t.Fatal(err)
+	}
+
+	video, err := upload(server, testUpload(t, server, filePath, store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if video.Video.UUID != "uploaded" {
+		t.Errorf("video = %+v, want the one the server returned", video.Video)
+	}
+	if fake.sessions != 0 {
+		t.Error("a new session was opened instead of resuming the saved one")
+	}
+	if string(fake.received) != content {
+		t.Errorf("server received %q, want %q", fake.received, content)
+	}
+	if _, ok := store.Get(key); ok {
+		t.Error("finished session is still saved")
+	}
+}
+
+func TestMultipartUploadContinuesAfterPartialChunk(t *testing.T) {
+	content := "0123456789"
+	filePath := writeTestFile(t, content)
+	fake := &resumableServer{keep: 3}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	video, err := upload(server, testUpload(t, server, filePath, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if video.Video.UUID != "uploaded" {
+		t.Errorf("video = %+v, want the one the server returned", video.Video)
+	}
+	if string(fake.received) != content {
+		t.Errorf("server received %q, want %q", fake.received, content)
+	}
+}
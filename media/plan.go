@@ -0,0 +1,269 @@
+package media
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"peertubeupload/config"
+	"peertubeupload/logger"
+	"peertubeupload/medialog"
+	"peertubeupload/model"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// PlanEntry is what a dry run found out about one file.
+type PlanEntry struct {
+	File                  string   `json:"file"`
+	Destination           string   `json:"destination,omitempty"`
+	Channel               string   `json:"channel,omitempty"`
+	Playlist              string   `json:"playlist,omitempty"`
+	Action                string   `json:"action"`
+	Reason                string   `json:"reason,omitempty"`
+	Title                 string   `json:"title"`
+	Description           string   `json:"description"`
+	ChannelID             int      `json:"channelId"`
+	Privacy               int      `json:"privacy"`
+	Size                  int64    `json:"size"`
+	Type                  string   `json:"type"`
+	OriginallyPublishedAt string   `json:"originallyPublishedAt,omitempty"`
+	Tags                  []string `json:"tags,omitempty"`
+	Captions              int      `json:"captions"`
+}
+
+const (
+	planUpload  = "upload"
+	planReplace = "replace"
+	planSkip    = "skip"
+)
+
+type planner struct {
+	c            *config.Config
+	destinations []config.Destination
+	index        *medialog.Index
+	mutex        sync.Mutex
+	entries      []PlanEntry
+}
+
+func (p *planner) add(entry PlanEntry) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.entries = append(p.entries, entry)
+}
+
+func (p *planner) skipped(path string, reason string) {
+	p.add(PlanEntry{File: path, Action: planSkip, Reason: reason})
+}
+
+// PlanFromFileSystem runs everything ProcessFromFileSystem does before the
+// upload, without logging in or uploading, and writes the plan to report.
+func PlanFromFileSystem(c config.Config, report string) error {
+	destinations, err := c.UploadDestinations()
+	if err != nil {
+		return err
+	}
+	p := &planner{c: &c, destinations: destinations, index: loadUploadIndex(&c, nil)}
+	filesChan := make(chan model.Media)
+	go gatherPathsFromFolder(context.Background(), &c, filesChan, p.skipped)
+
+	p.run(func(dispatch func(func())) {
+		for f := range filesChan {
+			f := f
+			dispatch(func() { p.plan(f, f.FilePath) })
+		}
+	})
+	return p.write(report)
+}
+
+// PlanFromDB is the dry run of ProcessFromDB.
+func PlanFromDB(db *sql.DB, c *config.Config, report string) error {
+	destinations, err := c.UploadDestinations()
+	if err != nil {
+		return err
+	}
+	p := &planner{c: c, destinations: destinations, index: loadUploadIndex(c, db)}
+	filechan := make(chan map[string]interface{})
+	go gatherPathsFromDB(context.Background(), db, c, filechan, p.skipped)
+
+	p.run(func(dispatch func(func())) {
+		for row := range filechan {
+			row := row
+			dispatch(func() { p.plan(mediaFromRow(c, row), medialog.RowKey(c, row)) })
+		}
+	})
+	return p.write(report)
+}
+
+// run probes files on processConfig.threads goroutines, ffprobe is the slow
+// part of a dry run on a large table.
+func (p *planner) run(feed func(dispatch func(func()))) {
+	threads := int64(p.c.ProccessConfig.Threads)
+	if threads < 1 {
+		threads = 1
+	}
+	ctx := context.Background()
+	sem := semaphore.NewWeighted(threads)
+	feed(func(work func()) {
+		_ = sem.Acquire(ctx, 1)
+		go func() {
+			defer sem.Release(1)
+			work()
+		}()
+	})
+	_ = sem.Acquire(ctx, threads)
+}
+
+// plan adds an entry for every destination media would go to.
+func (p *planner) plan(media model.Media, key string) {
+	base := PlanEntry{
+		File:        media.FilePath,
+		Action:      planUpload,
+		Title:       media.Title,
+		Description: media.Description,
+		Tags:        media.Tags,
+		Captions:    len(media.Captions),
+		Type:        "unknown",
+		Channel:     media.Channel,
+		Playlist:    media.Playlist,
+	}
+
+	// URLs are only fetched by the instance, a dry run can't look at them
+	if isRemote(media.FilePath) {
+		base.Type = "import"
+	} else {
+		info, err := os.Stat(media.FilePath)
+		if err != nil {
+			base.Action, base.Reason = planSkip, fmt.Sprintf("file not readable: %v", err)
+			p.add(base)
+			return
+		}
+		base.Size = info.Size()
+		if importField(media.FilePath) != "" {
+			base.Type = "import"
+		}
+	}
+
+	probed := false
+	var probeErr string
+	probe := func() {
+		if probed {
+			return
+		}
+		probed = true
+		if base.Type == "import" {
+			resolveCreateDate(p.c, &media)
+			base.OriginallyPublishedAt = media.CreateDate.Format(time.RFC3339)
+			return
+		}
+		metadata, err := getMetaData(media.FilePath)
+		if err != nil {
+			probeErr = "ffprobe can't read the file"
+			return
+		}
+		isVideo, isAudio := streamKinds(metadata)
+		switch {
+		case isVideo:
+			base.Type = "video"
+		case isAudio:
+			base.Type = "audio"
+		default:
+			probeErr = "no audio or video stream"
+			return
+		}
+		resolveCreateDate(p.c, &media)
+		base.OriginallyPublishedAt = media.CreateDate.Format(time.RFC3339)
+	}
+
+	for _, d := range p.destinations {
+		if !wantsDestination(media, d.Name) {
+			continue
+		}
+		entry := base
+		entry.Destination = d.Name
+		entry.ChannelID = d.ChannelID
+		// names are only resolved against the instance when uploading
+		if id, err := strconv.Atoi(media.Channel); err == nil && id > 0 && !media.ChannelRouted {
+			entry.ChannelID = id
+		}
+		entry.Privacy = d.Privacy
+		if media.Privacy > 0 {
+			entry.Privacy = media.Privacy
+		}
+
+		if previous, changed := changedSinceUpload(p.c, p.index, d.Name, key, &media); changed {
+			entry.Action, entry.Reason = planReplace, fmt.Sprintf("file changed since it was uploaded as %s", previous.UUID)
+		} else if uploaded, found := alreadyUploaded(p.c, p.index, d.Name, key, &media, nil); found {
+			entry.Action, entry.Reason = planSkip, fmt.Sprintf("already uploaded as %s", uploaded.UUID)
+			if p.c.LoadType.VerifyRemote {
+				entry.Reason += " (not verified on the instance in a dry run)"
+			}
+			p.add(entry)
+			continue
+		}
+
+		probe()
+		entry.Type, entry.OriginallyPublishedAt = base.Type, base.OriginallyPublishedAt
+		if probeErr != "" {
+			entry.Action, entry.Reason = planSkip, probeErr
+		}
+		p.add(entry)
+	}
+}
+
+// write prints a summary and saves the entries to report as JSON or CSV,
+// depending on its extension. Without a report every entry is logged.
+func (p *planner) write(report string) error {
+	sort.Slice(p.entries, func(i, j int) bool {
+		if p.entries[i].File != p.entries[j].File {
+			return p.entries[i].File < p.entries[j].File
+		}
+		return p.entries[i].Destination < p.entries[j].Destination
+	})
+
+	var uploads, skips int
+	var bytes int64
+	for _, entry := range p.entries {
+		if entry.Action != planSkip {
+			uploads++
+			bytes += entry.Size
+		} else {
+			skips++
+		}
+		if report == "" {
+			logger.LogInfo("Dry run", map[string]interface{}{"file": entry.File, "destination": entry.Destination, "action": entry.Action, "reason": entry.Reason, "title": entry.Title, "type": entry.Type, "size": entry.Size, "channel": entry.ChannelID, "privacy": entry.Privacy})
+		}
+	}
+	logger.LogInfo("Dry run finished", map[string]interface{}{"upload": uploads, "skip": skips, "bytes": bytes})
+
+	if report == "" {
+		return nil
+	}
+	file, err := os.Create(report)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if strings.ToLower(filepath.Ext(report)) == ".json" {
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", " ")
+		return encoder.Encode(p.entries)
+	}
+
+	w := csv.NewWriter(file)
+	_ = w.Write([]string{"file", "destination", "action", "reason", "title", "description", "channel", "playlist", "channelId", "privacy", "size", "type", "originallyPublishedAt", "tags", "captions"})
+	for _, e := range p.entries {
+		_ = w.Write([]string{e.File, e.Destination, e.Action, e.Reason, e.Title, e.Description, e.Channel, e.Playlist, strconv.Itoa(e.ChannelID), strconv.Itoa(e.Privacy), strconv.FormatInt(e.Size, 10), e.Type, e.OriginallyPublishedAt, strings.Join(e.Tags, ","), strconv.Itoa(e.Captions)})
+	}
+	w.Flush()
+	return w.Error()
+}
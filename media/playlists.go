@@ -0,0 +1,416 @@
+package media
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"peertubeupload/apiclient"
+	"peertubeupload/config"
+	"peertubeupload/logger"
+	"peertubeupload/model"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Orders accepted in playlistConfig.order.
+const (
+	PlaylistOrderNone     = "none"
+	PlaylistOrderEpisode  = "episode"
+	PlaylistOrderPosition = "position"
+)
+
+// defaultEpisodePattern finds the number in "S01E02", "ep 3" or "Episode_4".
+const defaultEpisodePattern = `(?i)(?:\b|_|\d)(?:episode|ep|e)[ ._-]*(\d+)`
+
+// playlistPublic is the privacy of created playlists unless
+// playlistConfig.privacy says otherwise.
+const playlistPublic = 1
+
+var (
+	episodePatternOnce sync.Once
+	episodePattern     *regexp.Regexp
+)
+
+// routePlaylist returns the name of the folder holding path when
+// playlistConfig.fromParentFolder is on. Files directly in folderConfig.path
+// are in no playlist.
+func routePlaylist(c *config.Config, path string) string {
+	if !c.PlaylistConfig.FromParentFolder {
+		return ""
+	}
+	parent := filepath.Dir(path)
+	if parent == "." || parent == filepath.Dir(parent) {
+		return ""
+	}
+	if c.FolderConfig.Path != "" && filepath.Clean(parent) == filepath.Clean(c.FolderConfig.Path) {
+		return ""
+	}
+	return filepath.Base(parent)
+}
+
+// episodeNumber matches playlistConfig.episodePattern against name and
+// returns the number in its first group, or in the whole match.
+func episodeNumber(c *config.Config, name string) (int, bool) {
+	episodePatternOnce.Do(func() {
+		expr := c.PlaylistConfig.EpisodePattern
+		if expr == "" {
+			expr = defaultEpisodePattern
+		}
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			logger.LogError("episodePattern is not a valid regular expression", map[string]interface{}{"error": err})
+			return
+		}
+		episodePattern = pattern
+	})
+	if episodePattern == nil {
+		return 0, false
+	}
+
+	match := episodePattern.FindStringSubmatch(name)
+	if match == nil {
+		return 0, false
+	}
+	value := match[0]
+	if len(match) > 1 {
+		value = match[1]
+	}
+	number, err := strconv.Atoi(value)
+	return number, err == nil
+}
+
+// playlistKey is what media is sorted by in its playlist, following
+// playlistConfig.order. ok is false when the video is simply appended.
+func playlistKey(c *config.Config, media model.Media) (key int, ok bool) {
+	switch c.PlaylistConfig.Order {
+	case "", PlaylistOrderNone:
+		return 0, false
+	case PlaylistOrderEpisode:
+		return episodeNumber(c, GetFileName(media.FilePath))
+	case PlaylistOrderPosition:
+		return media.PlaylistPosition, media.PlaylistPosition > 0
+	default:
+		logger.LogWarning("unknown playlist order, appending the video", map[string]interface{}{"order": c.PlaylistConfig.Order})
+		return 0, false
+	}
+}
+
+type videoPlaylist struct {
+	ID          int    `json:"id"`
+	DisplayName string `json:"displayName"`
+}
+
+type playlistElement struct {
+	ID       int `json:"id"`
+	Position int `json:"position"`
+	// Video is null for videos that were deleted or made private
+	Video *struct {
+		ID   int64  `json:"id"`
+		UUID string `json:"uuid"`
+		Name string `json:"name"`
+	} `json:"video"`
+}
+
+// playlistResolver finds or creates the playlists of one destination and
+// adds videos to them. Lookups are cached for the run.
+type playlistResolver struct {
+	mutex sync.Mutex
+	ids   map[string]int
+	// keys remembers the sort key of the videos added or found already
+	// uploaded during the run, by id and by uuid. The position order can't be
+	// read back from the instance
+	keys map[string]int
+}
+
+// addToPlaylist adds the uploaded video to media.Playlist on the destination
+// and moves it in place. A failure is logged, the video stays uploaded.
+func addToPlaylist(c *config.Config, t *target, channelID int, video model.VideoClass, media model.Media) {
+	if media.Playlist == "" {
+		return
+	}
+	if err := t.playlists.add(c, t.API, channelID, video, media); err != nil {
+		logger.LogError("not able to add video to playlist", map[string]interface{}{"error": err, "playlist": media.Playlist, "uuid": video.UUID, "destination": t.Name})
+		return
+	}
+	logger.LogInfo("Video added to playlist", map[string]interface{}{"playlist": media.Playlist, "uuid": video.UUID, "destination": t.Name})
+}
+
+// add is serialized per destination, so two files of the same playlist don't
+// create it twice or reorder it at the same time.
+func (r *playlistResolver) add(c *config.Config, api *apiclient.Client, channelID int, video model.VideoClass, media model.Media) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	playlistID, err := r.resolve(c, api, channelID, media.Playlist, !media.PlaylistRouted)
+	if err != nil {
+		return err
+	}
+	if err := addPlaylistVideo(api, playlistID, video); err != nil {
+		return err
+	}
+
+	key, ok := playlistKey(c, media)
+	if !ok {
+		return nil
+	}
+	r.rememberKey(video, key)
+	return r.reorder(c, api, playlistID, video, key)
+}
+
+// rememberUploaded keeps the sort key of media, uploaded by an earlier run,
+// so the videos of this run are placed around it.
+func rememberUploaded(c *config.Config, t *target, video model.VideoClass, media model.Media) {
+	if media.Playlist == "" {
+		return
+	}
+	if key, ok := playlistKey(c, media); ok {
+		t.playlists.mutex.Lock()
+		t.playlists.rememberKey(video, key)
+		t.playlists.mutex.Unlock()
+	}
+}
+
+func (r *playlistResolver) rememberKey(video model.VideoClass, key int) {
+	if r.keys == nil {
+		r.keys = map[string]int{}
+	}
+	if video.ID > 0 {
+		r.keys[strconv.FormatInt(video.ID, 10)] = key
+	}
+	if video.UUID != "" {
+		r.keys[video.UUID] = key
+	}
+}
+
+func (r *playlistResolver) knownKey(id int64, uuid string) (int, bool) {
+	if key, ok := r.keys[uuid]; ok && uuid != "" {
+		return key, true
+	}
+	key, ok := r.keys[strconv.FormatInt(id, 10)]
+	return key, ok
+}
+
+// resolve finds the playlist of the logged in account whose display name is
+// value, or with allowID whose id it is. A folder named 2024 is the playlist
+// named 2024, so routed names don't allow ids, and an id must be one of the
+// account's playlists on this destination. With playlistConfig.create a
+// missing playlist is created.
+func (r *playlistResolver) resolve(c *config.Config, api *apiclient.Client, channelID int, value string, allowID bool) (int, error) {
+	value = strings.TrimSpace(value)
+	id, err := strconv.Atoi(value)
+	byID := allowID && err == nil && id > 0
+	key := strings.ToLower(value)
+	if byID {
+		key = "#" + value
+	}
+	if cached, ok := r.ids[key]; ok {
+		return cached, nil
+	}
+	if r.ids == nil {
+		r.ids = map[string]int{}
+	}
+
+	playlists, err := listPlaylists(api)
+	if err != nil {
+		return 0, fmt.Errorf("not able to list playlists: %w", err)
+	}
+	if byID {
+		for _, playlist := range playlists {
+			if playlist.ID == id {
+				r.ids[key] = id
+				return id, nil
+			}
+		}
+		return 0, fmt.Errorf("playlist id %d is not a playlist of %s on this instance", id, api.Username)
+	}
+	for _, playlist := range playlists {
+		if strings.EqualFold(playlist.DisplayName, value) {
+			r.ids[key] = playlist.ID
+			return playlist.ID, nil
+		}
+	}
+
+	if !c.PlaylistConfig.Create {
+		return 0, fmt.Errorf("playlist %q doesn't exist on the instance, create it or enable playlistConfig.create", value)
+	}
+	privacy := c.PlaylistConfig.Privacy
+	if privacy <= 0 {
+		privacy = playlistPublic
+	}
+	id, err = createPlaylist(api, value, privacy, channelID)
+	if err != nil {
+		return 0, fmt.Errorf("not able to create playlist %q: %w", value, err)
+	}
+	logger.LogInfo("Playlist created", map[string]interface{}{"playlist": value, "id": id})
+	r.ids[key] = id
+	return id, nil
+}
+
+// reorder moves the video, just appended, in front of the first element
+// with a greater key. Elements without a key stay where they are.
+func (r *playlistResolver) reorder(c *config.Config, api *apiclient.Client, playlistID int, video model.VideoClass, key int) error {
+	elements, err := listPlaylistElements(api, playlistID)
+	if err != nil {
+		return err
+	}
+
+	current := 0
+	for _, e := range elements {
+		if e.Video != nil && e.Video.ID == video.ID && e.Position > current {
+			current = e.Position
+		}
+	}
+	if current == 0 {
+		return fmt.Errorf("video %s not found in playlist %d", video.UUID, playlistID)
+	}
+
+	for _, e := range elements {
+		if e.Video == nil || e.Position >= current {
+			continue
+		}
+		other, known := r.knownKey(e.Video.ID, e.Video.UUID)
+		if !known && c.PlaylistConfig.Order == PlaylistOrderEpisode {
+			other, known = episodeNumber(c, e.Video.Name)
+		}
+		if known && other > key {
+			return movePlaylistElement(api, playlistID, current, e.Position-1)
+		}
+	}
+	return nil
+}
+
+// listPlaylists returns the regular playlists of the account api is logged in
+// as, the watch later list is left out.
+func listPlaylists(api *apiclient.Client) ([]videoPlaylist, error) {
+	var playlists []videoPlaylist
+	for {
+		var page struct {
+			Total int             `json:"total"`
+			Data  []videoPlaylist `json:"data"`
+		}
+		if err := getJSON(api, fmt.Sprintf("%s/accounts/%s/video-playlists?playlistType=1&start=%d&count=100", api.BaseURL, url.PathEscape(api.Username), len(playlists)), &page); err != nil {
+			return nil, err
+		}
+		playlists = append(playlists, page.Data...)
+		if len(page.Data) == 0 || len(playlists) >= page.Total {
+			return playlists, nil
+		}
+	}
+}
+
+func listPlaylistElements(api *apiclient.Client, playlistID int) ([]playlistElement, error) {
+	var elements []playlistElement
+	for {
+		var page struct {
+			Total int               `json:"total"`
+			Data  []playlistElement `json:"data"`
+		}
+		if err := getJSON(api, fmt.Sprintf("%s/video-playlists/%d/videos?start=%d&count=100", api.BaseURL, playlistID, len(elements)), &page); err != nil {
+			return nil, err
+		}
+		elements = append(elements, page.Data...)
+		if len(page.Data) == 0 || len(elements) >= page.Total {
+			return elements, nil
+		}
+	}
+}
+
+// createPlaylist creates a playlist shown as displayName and returns its id.
+// PeerTube needs a channel for public playlists, it gets the one of the video.
+func createPlaylist(api *apiclient.Client, displayName string, privacy int, channelID int) (int, error) {
+	payload := &bytes.Buffer{}
+	writer := multipart.NewWriter(payload)
+	_ = writer.WriteField("displayName", truncate(displayName, 120))
+	_ = writer.WriteField("privacy", strconv.Itoa(privacy))
+	if channelID > 0 {
+		_ = writer.WriteField("videoChannelId", strconv.Itoa(channelID))
+	}
+	if err := writer.Close(); err != nil {
+		return 0, err
+	}
+
+	var created struct {
+		VideoPlaylist struct {
+			ID int `json:"id"`
+		} `json:"videoPlaylist"`
+	}
+	if err := sendJSON(api, "POST", api.BaseURL+"/video-playlists", writer.FormDataContentType(), payload.Bytes(), &created); err != nil {
+		return 0, err
+	}
+	return created.VideoPlaylist.ID, nil
+}
+
+// addPlaylistVideo appends video to the end of the playlist.
+func addPlaylistVideo(api *apiclient.Client, playlistID int, video model.VideoClass) error {
+	data, err := json.Marshal(map[string]interface{}{"videoId": video.ID})
+	if err != nil {
+		return err
+	}
+	return sendJSON(api, "POST", fmt.Sprintf("%s/video-playlists/%d/videos", api.BaseURL, playlistID), "application/json", data, nil)
+}
+
+// movePlaylistElement moves the element at position right after
+// insertAfter, 0 being the start of the playlist.
+func movePlaylistElement(api *apiclient.Client, playlistID int, position int, insertAfter int) error {
+	data, err := json.Marshal(map[string]interface{}{
+		"startPosition":       position,
+		"insertAfterPosition": insertAfter,
+		"reorderLength":       1,
+	})
+	if err != nil {
+		return err
+	}
+	return sendJSON(api, "POST", fmt.Sprintf("%s/video-playlists/%d/videos/reorder", api.BaseURL, playlistID), "application/json", data, nil)
+}
+
+func getJSON(api *apiclient.Client, endpoint string, out interface{}) error {
+	res, err := api.Do(func() (*http.Request, error) {
+		return http.NewRequest("GET", endpoint, nil)
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %s: %s", endpoint, res.Status, body)
+	}
+	return json.Unmarshal(body, out)
+}
+
+// sendJSON sends data and decodes the answer into out unless it is nil.
+func sendJSON(api *apiclient.Client, method string, endpoint string, contentType string, data []byte, out interface{}) error {
+	res, err := api.Do(func() (*http.Request, error) {
+		req, err := http.NewRequest(method, endpoint, bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", contentType)
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("%s %s returned %s: %s", method, endpoint, res.Status, body)
+	}
+	if out == nil || len(body) == 0 {
+		return nil
+	}
+	return json.Unmarshal(body, out)
+}
@@ -0,0 +1,105 @@
+package media
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"peertubeupload/apiclient"
+	"peertubeupload/config"
+	"peertubeupload/login"
+	"peertubeupload/model"
+	"testing"
+)
+
+func TestEpisodeNumber(t *testing.T) {
+	c := &config.Config{}
+	tests := []struct {
+		name   string
+		want   int
+		wantOK bool
+	}{
+		{"Show S01E02", 2, true},
+		{"show.s02e13.720p", 13, true},
+		{"Show ep 3", 3, true},
+		{"Show Episode_4", 4, true},
+		{"Show - E05", 5, true},
+		{"Show 2024", 0, false},
+		{"Recipe", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := episodeNumber(c, tt.name)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("episodeNumber(%q) = %d, %v, want %d, %v", tt.name, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestReorderPlacesNewVideoBeforeEarlierRun(t *testing.T) {
+	var moved map[string]int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/video-playlists/5/videos":
+			json.NewEncoder(w).Encode(map[string]interface{}{"total": 2, "data": []map[string]interface{}{
+				{"id": 1, "position": 1, "video": map[string]interface{}{"id": 10, "uuid": "uploaded-earlier", "name": "Part two"}},
+				{"id": 2, "position": 2, "video": map[string]interface{}{"id": 11, "uuid": "new", "name": "Part one"}},
+			}})
+		case "/api/v1/video-playlists/5/videos/reorder":
+			json.NewDecoder(r.Body).Decode(&moved)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	api := apiclient.New(server.Client(), &login.LoginManager{}, nil, server.URL+"/api/v1", "alice", "")
+
+	c := &config.Config{}
+	c.PlaylistConfig.Order = PlaylistOrderPosition
+	var r playlistResolver
+	// the log only knows the uuid of the video of the earlier run
+	r.rememberKey(model.VideoClass{UUID: "uploaded-earlier"}, 2)
+
+	if err := r.reorder(c, api, 5, model.VideoClass{ID: 11, UUID: "new"}, 1); err != nil {
+		t.Fatal(err)
+	}
+	if moved["startPosition"] != 2 || moved["insertAfterPosition"] != 0 {
+		t.Errorf("reorder sent %v, want the video at 2 moved to the start", moved)
+	}
+}
+
+func TestPlaylistResolverResolve(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/accounts/alice/video-playlists" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"total": 2, "data": []videoPlaylist{
+			{ID: 3, DisplayName: "Concerts"},
+			{ID: 5, DisplayName: "2024"},
+		}})
+	}))
+	defer server.Close()
+	api := apiclient.New(server.Client(), &login.LoginManager{}, nil, server.URL+"/api/v1", "alice", "")
+	c := &config.Config{}
+
+	tests := []struct {
+		value   string
+		allowID bool
+		want    int
+		wantErr bool
+	}{
+		{"concerts", false, 3, false},
+		// a folder named 2024 is the playlist named 2024, not id 2024
+		{"2024", false, 5, false},
+		{"3", true, 3, false},
+		{"2024", true, 0, true},
+		{"missing", false, 0, true},
+	}
+	for _, tt := range tests {
+		var r playlistResolver
+		got, err := r.resolve(c, api, 0, tt.value, tt.allowID)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("resolve(%q, %v) = %d, %v, want %d, error %v", tt.value, tt.allowID, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
@@ -5,202 +5,171 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
-	"net/http"
 	"os"
 	"path/filepath"
-	"peertubeupload/auth"
 	"peertubeupload/config"
 	"peertubeupload/logger"
 	"peertubeupload/medialog"
 	"peertubeupload/model"
+	"peertubeupload/state"
 	"strings"
 	"time"
 
 	"golang.org/x/sync/semaphore"
 )
 
-var baseURL string
+// ProcessFromFileSystem uploads the files of folderConfig.path to every
+// destination. Cancelling
+// ctx stops it from starting new files, see waitForUploads for the ones in
+// progress.
+func ProcessFromFileSystem(ctx context.Context, c config.Config, filesChan chan model.Media, destinations []Destination, store *state.Store) {
 
-func ProcessFromFileSystem(c config.Config, filesChan chan model.Media, loginClient *model.Login, client *http.Client, loginManager auth.Authenticator) {
-
-	baseURL = fmt.Sprintf("%s:%s/api/v1", c.APIConfig.URL, c.APIConfig.Port)
-	ctx := context.Background()
+	uploadCtx, cancelUploads := context.WithCancel(context.Background())
+	defer cancelUploads()
 
 	sem := semaphore.NewWeighted(int64(c.ProccessConfig.Threads))
-	go gatherPathsFromFolder(&c, filesChan)
+	index := loadUploadIndex(&c, nil)
+	targets := newTargets(destinations)
+	var queue *watchQueue
+	if c.FolderConfig.Watch {
+		queue = newWatchQueue()
+		go watchFolder(ctx, &c, filesChan, store, queue)
+	} else {
+		go gatherPathsFromFolder(ctx, &c, filesChan, nil)
+	}
 
 	for f := range filesChan {
-		if err := sem.Acquire(ctx, 1); err != nil {
-			// handle the error
-			log.Fatalf("Failed to acquire semaphore: %v", err)
+		// Acquire fails once ctx is cancelled
+		if ctx.Err() != nil || sem.Acquire(ctx, 1) != nil {
+			break
 		}
 		go func(f model.Media) {
 			defer sem.Release(1)
 			// Process the file
 
-			err := loginManager.UpdateTokenIfNeeded(baseURL, client, loginClient, "password", c.APIConfig.Username, c.APIConfig.Password)
-			if err != nil {
-				logger.LogError("Unable to get access token", map[string]interface{}{"error": err})
-				return
-			}
-
-			fileData, err := os.Stat(f.FilePath)
-			if err != nil {
-				logger.LogError("unable to get file data to retrive the original date, today date will be submitted", map[string]interface{}{"error": err})
-				fileData = nil
-			}
-
-			var video model.Video
+			results := uploadEverywhere(uploadCtx, &c, targets, index, f.FilePath, f, store, func(t *target, media model.Media, video model.Video, replaced bool) {
+				if c.LoadType.LogType == "file" {
+					// a replacement is appended too, the last entry of a file wins
+					err := medialog.LogResultToFile(video, media, &c, t.Name)
+					if err != nil {
+						logger.LogError("failed to log result in file", map[string]interface{}{"error": err})
+					}
 
-			if fileData != nil {
-				f.CreateDate = fileData.ModTime()
-				// video, err = UploadMedia(baseURL, client, f.Title, "", fileData.ModTime().Format("2006-01-02 15:04:05"), loginManager.GetAccessToken(), f.FilePath, &c)
-				video, err = UploadMediaInChunksOS(&c, f, loginManager.GetAccessToken())
-			} else {
-				f.CreateDate = time.Now()
-				// video, err = UploadMedia(baseURL, client, f.Title, "", time.Now().Format("2006-01-02 15:04:05"), loginManager.GetAccessToken(), f.FilePath, &c)
-				video, err = UploadMediaInChunksOS(&c, f, loginManager.GetAccessToken())
-			}
-			if err != nil {
-				logger.LogError("error uploading media", map[string]interface{}{"error": err, "file": f.FilePath})
+				} else if c.LoadType.LogType == "none" {
+					logger.LogInfo("DONE UPLOADING ", map[string]interface{}{"file": media.FilePath, "destination": t.Name, "replaced": replaced})
+				}
+			})
+			if allSkipped(results) || uploadCtx.Err() != nil {
+				// a shutdown stopping the upload is not a failure of the file
 				return
 			}
 
-			if c.LoadType.LogType == "file" {
-
-				err := medialog.LogResultToFile(video, f, &c)
-				if err != nil {
-					logger.LogError("failed to log result in file", map[string]interface{}{"error": err})
+			succeeded := allSucceeded(results)
+			if succeeded && c.FolderConfig.Watch {
+				if err := store.MarkHandled(f.FilePath); err != nil {
+					logger.LogWarning("not able to remember the file as handled", map[string]interface{}{"error": err, "file": f.FilePath})
 				}
-
-			} else if c.LoadType.LogType == "none" {
-				logger.LogInfo("DONE UPLOADING ", map[string]interface{}{"file": f.FilePath})
+			} else if !succeeded {
+				// watched again, so the upload is retried after a while
+				queue.failed(f.FilePath, time.Now())
 			}
+			disposeSource(&c, f.FilePath, results, succeeded)
 
 		}(f)
 	}
 	// Wait for all processing to complete
-	if err := sem.Acquire(ctx, (int64(c.ProccessConfig.Threads))); err != nil {
-		// handle the error
-		log.Fatalf("Failed to acquire semaphore: %v", err)
-	}
+	waitForUploads(ctx, &c, sem, int64(c.ProccessConfig.Threads), cancelUploads)
 }
 
-func ProcessFromDB(db *sql.DB, config *config.Config, filechan chan map[string]interface{}, loginClient *model.Login, client *http.Client, loginManager auth.Authenticator) {
+// ProcessFromDB uploads the rows of dbConfig.tableName to every destination.
+// Cancelling ctx stops it from starting new rows, see waitForUploads for the
+// ones in progress.
+func ProcessFromDB(ctx context.Context, db *sql.DB, config *config.Config, filechan chan map[string]interface{}, destinations []Destination, store *state.Store) {
 
-	baseURL = fmt.Sprintf("%s:%s/api/v1", config.APIConfig.URL, config.APIConfig.Port)
-	ctx := context.Background()
-	var err error
+	uploadCtx, cancelUploads := context.WithCancel(context.Background())
+	defer cancelUploads()
 	sem := semaphore.NewWeighted(int64(config.ProccessConfig.Threads))
+	index := loadUploadIndex(config, db)
+	targets := newTargets(destinations)
 
-	go gatherPathsFromDB(db, config, filechan)
+	go gatherPathsFromDB(ctx, db, config, filechan, nil)
 
 	for f := range filechan {
-		if err := sem.Acquire(ctx, 1); err != nil {
-			// handle the error
-			log.Fatalf("Failed to acquire semaphore: %v", err)
+		// Acquire fails once ctx is cancelled
+		if ctx.Err() != nil || sem.Acquire(ctx, 1) != nil {
+			break
 		}
 		go func(f map[string]interface{}) {
 			defer sem.Release(1)
 			// Process the file
 
-			err = loginManager.UpdateTokenIfNeeded(baseURL, client, loginClient, "password", config.APIConfig.Username, config.APIConfig.Password)
-			if err != nil {
-				logger.LogError("Unable to get access token", map[string]interface{}{"error": err})
-				return
-			}
-
-			filePath := fmt.Sprintf("%v", f[config.DBConfig.FilePath])
-
-			fileData, err := os.Stat(filePath)
-			if err != nil {
-				logger.LogError("unable to get file data to retrive the original date, today date will be submitted", map[string]interface{}{"error": err})
-				fileData = nil
-			}
-
-			var video model.Video
-
-			title := fmt.Sprintf("%v", f[config.DBConfig.Title])
-			description := fmt.Sprintf("%v", f[config.DBConfig.Description])
+			media := mediaFromRow(config, f)
+			key := medialog.RowKey(config, f)
 
-			if fileData != nil {
-				media := model.Media{
-					Title:       title,
-					Description: description,
-					FilePath:    filePath,
-					CreateDate:  fileData.ModTime(),
-				}
-				video, err = UploadMediaInChunksOS(config, media, loginManager.GetAccessToken())
-
-				// video, err = UploadMedia(baseURL, client, title, "", fileData.ModTime().Format("2006-01-02 15:04:05"), loginManager.GetAccessToken(), filePath, config)
+			results := uploadEverywhere(uploadCtx, config, targets, index, key, media, store, func(t *target, media model.Media, video model.Video, replaced bool) {
+				if config.LoadType.LogType == "db" {
+					// every destination logs its own row
+					row := make(map[string]interface{}, len(f)+2)
+					for k, v := range f {
+						row[k] = v
+					}
+					if config.LoadType.MatchByHash {
+						row["hash"] = media.Hash
+					}
+					row[medialog.DestinationColumn] = t.Name
 
-			} else {
+					var err error
+					if replaced {
+						err = medialog.UpdateReplacedInDB(video, row, config, db)
+					} else {
+						err = medialog.LogResultToDB(video, row, config, db, media.FilePath)
+					}
+					if err != nil {
+						logger.LogError("failed to log result in DB", map[string]interface{}{"error": err})
+					}
 
-				media := model.Media{
-					Title:       title,
-					Description: description,
-					FilePath:    filePath,
-					CreateDate:  time.Now(),
+				} else if config.LoadType.LogType == "none" {
+					logger.LogInfo("DONE UPLOADING ", map[string]interface{}{"file": media.FilePath, "destination": t.Name, "replaced": replaced})
 				}
-
-				video, err = UploadMediaInChunksOS(config, media, loginManager.GetAccessToken())
-				// video, err = UploadMedia(baseURL, client, title, "", time.Now().Format("2006-01-02 15:04:05"), loginManager.GetAccessToken(), filePath, config)
-
-			}
-			if err != nil {
-				logger.LogError("error uploading media", map[string]interface{}{"error": err, "file": filePath})
+			})
+			if allSkipped(results) || uploadCtx.Err() != nil {
+				// a shutdown stopping the upload is not a failure of the file
 				return
 			}
 
-			if config.LoadType.LogType == "db" {
-
-				err = medialog.LogResultToDB(video, f, config, db, filePath)
-				if err != nil {
-					logger.LogError("failed to log result in DB", map[string]interface{}{"error": err})
-				}
-
-			} else if config.LoadType.LogType == "none" {
-				logger.LogInfo("DONE UPLOADING ", map[string]interface{}{"file": filePath})
-			}
+			disposeSource(config, media.FilePath, results, allSucceeded(results))
 
 		}(f)
 	}
 	// Wait for all processing to complete
-	if err := sem.Acquire(ctx, (int64(config.ProccessConfig.Threads))); err != nil {
-		// handle the error
-		log.Fatalf("Failed to acquire semaphore: %v", err)
-	}
+	waitForUploads(ctx, config, sem, int64(config.ProccessConfig.Threads), cancelUploads)
 }
 
-func gatherPathsFromFolder(c *config.Config, filesChan chan<- model.Media) {
+// gatherPathsFromFolder walks folderConfig.path once and sends every file to
+// upload to filesChan, until ctx is cancelled. Files filtered out are
+// reported to onSkip when it isn't nil.
+func gatherPathsFromFolder(ctx context.Context, c *config.Config, filesChan chan<- model.Media, onSkip func(path string, reason string)) {
 
 	err := filepath.Walk(c.FolderConfig.Path, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			logger.LogError("Error accessing path", map[string]interface{}{"Path": path, "error": err})
 			return nil
 		}
-		if !info.IsDir() {
-			if c.LoadType.SpecificExtensions {
-				fileExt := strings.ToLower(filepath.Ext(info.Name()))
-				for _, ext := range c.LoadType.Extensions {
-					if ext == fileExt {
-						filesChan <- model.Media{
-							Title:       GetFileName(path),
-							Description: "",
-							FilePath:    path,
-						}
-						break
-					}
-				}
-			} else {
-				filesChan <- model.Media{
-					Title:       GetFileName(path),
-					Description: "",
-					FilePath:    path,
-				}
+		if info.IsDir() {
+			return nil
+		}
+		if !acceptFile(c, info.Name()) {
+			if onSkip != nil && !sidecarExtensions[strings.ToLower(filepath.Ext(info.Name()))] {
+				onSkip(path, "extension not in loadType.extensions")
 			}
+			return nil
+		}
+		select {
+		case filesChan <- mediaFromFolder(c, path):
+			return nil
+		case <-ctx.Done():
+			return filepath.SkipAll
 		}
-		return nil
 	})
 	if err != nil {
 		logger.LogError("Error walking the path", map[string]interface{}{"Path": c.FolderConfig.Path, "error": err})
@@ -208,9 +177,36 @@ func gatherPathsFromFolder(c *config.Config, filesChan chan<- model.Media) {
 	close(filesChan)
 }
 
-func gatherPathsFromDB(db *sql.DB, config *config.Config, filechan chan<- map[string]interface{}) {
+// acceptFile reports whether a file found in the folder should be uploaded,
+// based on loadType.extensions or, without them, on not being a sidecar.
+// Files renamed after their upload are never accepted again.
+func acceptFile(c *config.Config, name string) bool {
+	if c.DispositionConfig.OnSuccess == DispositionRename && renamedWithUUID(name) {
+		return false
+	}
+	if !c.LoadType.SpecificExtensions {
+		return !sidecarExtensions[strings.ToLower(filepath.Ext(name))]
+	}
+	return hasAllowedExtension(c, name)
+}
+
+func hasAllowedExtension(c *config.Config, name string) bool {
+	fileExt := strings.ToLower(filepath.Ext(name))
+	for _, ext := range c.LoadType.Extensions {
+		if ext == fileExt {
+			return true
+		}
+	}
+	return false
+}
+
+// gatherPathsFromDB sends the rows of dbConfig.tableName to filechan, until
+// ctx is cancelled. Rows filtered out are reported to onSkip when it isn't
+// nil.
+func gatherPathsFromDB(ctx context.Context, db *sql.DB, config *config.Config, filechan chan<- map[string]interface{}, onSkip func(path string, reason string)) {
 	// Query the database for video details
 	combinedColumns := append([]string{config.DBConfig.Title, config.DBConfig.Description, config.DBConfig.FilePath}, config.DBConfig.MediaIdentifier...)
+	combinedColumns = append(combinedColumns, metadataColumns(config)...)
 	rows, err := db.Query(fmt.Sprintf("SELECT %s FROM %s",
 		strings.Join(combinedColumns, ","), config.DBConfig.TableName))
 	// rows, err := db.Query(fmt.Sprintf("SELECT %s, %s, %s FROM %s",
@@ -245,17 +241,20 @@ func gatherPathsFromDB(db *sql.DB, config *config.Config, filechan chan<- map[st
 		// }
 
 		if config.LoadType.SpecificExtensions {
-			filePath := fmt.Sprintf("%v", row[config.DBConfig.FilePath])
-			filename := filepath.Base(filePath)
-			fileExt := strings.ToLower(filepath.Ext(filename))
-			for _, ext := range config.LoadType.Extensions {
-				if ext == fileExt {
-					filechan <- row
-					break
+			filePath := columnString(row, config.DBConfig.FilePath)
+			// URLs rarely end in an extension, they are imported as they are
+			if !isRemote(filePath) && !hasAllowedExtension(config, filepath.Base(filePath)) {
+				if onSkip != nil {
+					onSkip(filePath, "extension not in loadType.extensions")
 				}
+				continue
 			}
-		} else {
-			filechan <- row
+		}
+		select {
+		case filechan <- row:
+		case <-ctx.Done():
+			close(filechan)
+			return
 		}
 
 	}
@@ -0,0 +1,102 @@
+package media
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"peertubeupload/config"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetryPolicy is how often a failed chunk is sent again and how long to wait
+// in between.
+type RetryPolicy struct {
+	Attempts  int
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+func RetryPolicyFromConfig(c *config.Config) RetryPolicy {
+	return RetryPolicy{
+		Attempts:  c.RetryConfig.Attempts,
+		BaseDelay: time.Duration(c.RetryConfig.BaseDelay) * time.Second,
+		MaxDelay:  time.Duration(c.RetryConfig.MaxDelay) * time.Second,
+	}
+}
+
+// withDefaults fills in the values left at zero in the config.
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.Attempts <= 0 {
+		p.Attempts = 5
+	}
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = 2 * time.Second
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = 2 * time.Minute
+	}
+	if p.MaxDelay < p.BaseDelay {
+		p.MaxDelay = p.BaseDelay
+	}
+	return p
+}
+
+// backoff is the wait after the given failed attempt: the base delay doubled
+// on every attempt up to the max delay, with half of it random so threads
+// that failed together don't all retry at the same moment.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.MaxDelay
+	if attempt < 31 {
+		if d := p.BaseDelay << (attempt - 1); d > 0 && d < p.MaxDelay {
+			delay = d
+		}
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// retryableStatus reports whether a chunk that got status is worth sending
+// again. Other errors, like a 403 or 413, won't go away by retrying.
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError,
+		http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// parseRetryAfter reads a Retry-After header, given either in seconds or as
+// an HTTP date.
+func parseRetryAfter(header string) (time.Duration, bool) {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		wait := time.Until(date)
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+	return 0, false
+}
+
+// sleepContext waits for d, or returns early with ctx's error once it is
+// cancelled.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,150 @@
+package media
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: 2 * time.Second, MaxDelay: 20 * time.Second}
+	tests := []struct {
+		attempt int
+		delay   time.Duration
+	}{
+		{1, 2 * time.Second},
+		{2, 4 * time.Second},
+		{3, 8 * time.Second},
+		{4, 16 * time.Second},
+		{5, 20 * time.Second},
+		{40, 20 * time.Second},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 20; i++ {
+			got := policy.backoff(tt.attempt)
+			if got < tt.delay/2 || got > tt.delay {
+				t.Fatalf("backoff(%d) = %v, want between %v and %v", tt.attempt, got, tt.delay/2, tt.delay)
+			}
+		}
+	}
+}
+
+func TestRetryPolicyWithDefaults(t *testing.T) {
+	got := RetryPolicy{BaseDelay: 10 * time.Second, MaxDelay: time.Second}.withDefaults()
+	want := RetryPolicy{Attempts: 5, BaseDelay: 10 * time.Second, MaxDelay: 10 * time.Second}
+	if got != want {
+		t.Errorf("withDefaults() = %+v, want %+v", got, want)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		header string
+		want   time.Duration
+		wantOK bool
+	}{
+		{"120", 2 * time.Minute, true},
+		{" 0 ", 0, true},
+		{"", 0, false},
+		{"-5", 0, false},
+		{"soon", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseRetryAfter(tt.header)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("parseRetryAfter(%q) = %v, %v, want %v, %v", tt.header, got, ok, tt.want, tt.wantOK)
+		}
+	}
+
+	date := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	if got, ok := parseRetryAfter(date); !ok || got < 59*time.Minute || got > time.Hour {
+		t.Errorf("parseRetryAfter(%q) = %v, %v, want about an hour", date, got, ok)
+	}
+}
+
+// flakyHandler answers the first chunks sent to next with statuses.
+type flakyHandler struct {
+	mutex      sync.Mutex
+	statuses   []int
+	retryAfter string
+	chunks     int
+	next       http.Handler
+}
+
+func (h *flakyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mutex.Lock()
+	if r.Method == "PUT" && !strings.HasPrefix(r.Header.Get("Content-Range"), "bytes */") {
+		h.chunks++
+		if len(h.statuses) > 0 {
+			status := h.statuses[0]
+			h.statuses = h.statuses[1:]
+			h.mutex.Unlock()
+			if h.retryAfter != "" {
+				w.Header().Set("Retry-After", h.retryAfter)
+			}
+			w.WriteHeader(status)
+			return
+		}
+	}
+	h.mutex.Unlock()
+	h.next.ServeHTTP(w, r)
+}
+
+func TestUploadRetriesChunkAfterRetryAfter(t *testing.T) {
+	content := "0123456789"
+	fake := &resumableServer{}
+	flaky := &flakyHandler{statuses: []int{http.StatusTooManyRequests, http.StatusServiceUnavailable}, retryAfter: "0", next: fake}
+	server := httptest.NewServer(flaky)
+	defer server.Close()
+
+	input := testUpload(t, server, writeTestFile(t, content), nil)
+	// without Retry-After the test would wait for the backoff
+	input.Retry = RetryPolicy{Attempts: 3, BaseDelay: time.Minute, MaxDelay: time.Minute}
+	start := time.Now()
+	if _, err := upload(server, input); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("upload took %v, Retry-After: 0 wasn't honoured", elapsed)
+	}
+	if string(fake.received) != content {
+		t.Errorf("server received %q, want %q", fake.received, content)
+	}
+	// 2 refused, then the 3 chunks of 4 bytes
+	if flaky.chunks != 5 {
+		t.Errorf("%d chunks sent, want 5", flaky.chunks)
+	}
+}
+
+func TestUploadGivesUpAfterAttempts(t *testing.T) {
+	flaky := &flakyHandler{statuses: []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway}, retryAfter: "0", next: &resumableServer{}}
+	server := httptest.NewServer(flaky)
+	defer server.Close()
+
+	input := testUpload(t, server, writeTestFile(t, "0123456789"), nil)
+	input.Retry = RetryPolicy{Attempts: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	if _, err := upload(server, input); err == nil {
+		t.Fatal("upload succeeded, want it to fail after 2 attempts")
+	}
+	if flaky.chunks != 2 {
+		t.Errorf("%d chunks sent, want 2", flaky.chunks)
+	}
+}
+
+func TestUploadDoesNotRetryForbidden(t *testing.T) {
+	flaky := &flakyHandler{statuses: []int{http.StatusForbidden}, next: &resumableServer{}}
+	server := httptest.NewServer(flaky)
+	defer server.Close()
+
+	input := testUpload(t, server, writeTestFile(t, "0123456789"), nil)
+	input.Retry = RetryPolicy{Attempts: 5, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	if _, err := upload(server, input); err == nil {
+		t.Fatal("upload succeeded, want the 403 to fail it")
+	}
+	if flaky.chunks != 1 {
+		t.Errorf("%d chunks sent, want 1", flaky.chunks)
+	}
+}
@@ -0,0 +1,53 @@
+package media
+
+import (
+	"context"
+	"peertubeupload/config"
+	"peertubeupload/logger"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// defaultDrainTimeout is the grace period of uploads in progress when the
+// configuration has no processConfig.drainTimeout.
+const defaultDrainTimeout = 60 * time.Second
+
+// waitForUploads blocks until the uploads holding sem are done. Once ctx is
+// cancelled they get processConfig.drainTimeout seconds to finish, after that
+// cancelUploads stops them mid-chunk and MultipartUploadHandler keeps or
+// deletes their sessions. A drainTimeout of 0 or less lets them run to the
+// end, only a second signal stops them then.
+func waitForUploads(ctx context.Context, c *config.Config, sem *semaphore.Weighted, threads int64, cancelUploads context.CancelFunc) {
+	done := make(chan struct{})
+	go func() {
+		_ = sem.Acquire(context.Background(), threads)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-ctx.Done():
+	}
+
+	drain := defaultDrainTimeout
+	if c.ProccessConfig.DrainTimeout != nil {
+		drain = time.Duration(*c.ProccessConfig.DrainTimeout) * time.Second
+	}
+	var drained <-chan time.Time
+	if drain > 0 {
+		drained = time.After(drain)
+		logger.LogWarning("shutting down, no new uploads will be started", map[string]interface{}{"drainTimeout": drain.String()})
+	} else {
+		logger.LogWarning("shutting down, no new uploads will be started, waiting for the ones in progress", nil)
+	}
+	select {
+	case <-done:
+		logger.LogInfo("Uploads in progress finished", nil)
+	case <-drained:
+		logger.LogWarning("drain timeout reached, stopping uploads in progress", nil)
+		cancelUploads()
+		<-done
+	}
+}
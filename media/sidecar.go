@@ -0,0 +1,221 @@
+package media
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"peertubeupload/logger"
+	"peertubeupload/model"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// sidecarExtensions are never uploaded themselves, even when
+// loadType.specificextensions is off.
+var sidecarExtensions = map[string]bool{
+	".json": true,
+	".yaml": true,
+	".yml":  true,
+	".nfo":  true,
+	".srt":  true,
+	".vtt":  true,
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".webp": true,
+}
+
+// Sidecar is the metadata a file next to a media file can carry. The same
+// fields are read from JSON and YAML, a Kodi .nfo is mapped onto them.
+type Sidecar struct {
+	Title                 string           `json:"title" yaml:"title"`
+	Description           string           `json:"description" yaml:"description"`
+	Tags                  []string         `json:"tags" yaml:"tags"`
+	Category              int              `json:"category" yaml:"category"`
+	Language              string           `json:"language" yaml:"language"`
+	Licence               int              `json:"licence" yaml:"licence"`
+	Privacy               int              `json:"privacy" yaml:"privacy"`
+	OriginallyPublishedAt string           `json:"originallyPublishedAt" yaml:"originallyPublishedAt"`
+	Thumbnail             string           `json:"thumbnail" yaml:"thumbnail"`
+	Captions              []SidecarCaption `json:"captions" yaml:"captions"`
+	Destinations          []string         `json:"destinations" yaml:"destinations"`
+	Channel               string           `json:"channel" yaml:"channel"`
+	Playlist              string           `json:"playlist" yaml:"playlist"`
+	PlaylistPosition      int              `json:"playlistPosition" yaml:"playlistPosition"`
+}
+
+type SidecarCaption struct {
+	Language string `json:"language" yaml:"language"`
+	Path     string `json:"path" yaml:"path"`
+}
+
+type kodiNfo struct {
+	Title     string   `xml:"title"`
+	Plot      string   `xml:"plot"`
+	Outline   string   `xml:"outline"`
+	Tags      []string `xml:"tag"`
+	Genres    []string `xml:"genre"`
+	Premiered string   `xml:"premiered"`
+	Aired     string   `xml:"aired"`
+	Year      string   `xml:"year"`
+	Thumb     string   `xml:"thumb"`
+}
+
+// sidecarCandidates lists where the sidecar of mediaPath may be, in the order
+// they are tried. Both video.mp4.json and video.json are accepted.
+func sidecarCandidates(mediaPath string) []string {
+	withoutExt := strings.TrimSuffix(mediaPath, filepath.Ext(mediaPath))
+	return []string{
+		mediaPath + ".json",
+		withoutExt + ".json",
+		mediaPath + ".yaml",
+		mediaPath + ".yml",
+		withoutExt + ".yaml",
+		withoutExt + ".yml",
+		withoutExt + ".nfo",
+	}
+}
+
+// findSidecar reads the first sidecar found next to mediaPath. It returns nil
+// when there is none.
+func findSidecar(mediaPath string) (*Sidecar, string, error) {
+	for _, candidate := range sidecarCandidates(mediaPath) {
+		data, err := os.ReadFile(candidate)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, candidate, err
+		}
+
+		sidecar := &Sidecar{}
+		switch strings.ToLower(filepath.Ext(candidate)) {
+		case ".json":
+			err = json.Unmarshal(data, sidecar)
+		case ".yaml", ".yml":
+			err = yaml.Unmarshal(data, sidecar)
+		case ".nfo":
+			sidecar, err = parseNfo(data)
+		}
+		if err != nil {
+			return nil, candidate, fmt.Errorf("not able to parse sidecar %s: %w", candidate, err)
+		}
+		return sidecar, candidate, nil
+	}
+	return nil, "", nil
+}
+
+func parseNfo(data []byte) (*Sidecar, error) {
+	var nfo kodiNfo
+	if err := xml.Unmarshal(data, &nfo); err != nil {
+		return nil, err
+	}
+
+	sidecar := &Sidecar{
+		Title:       nfo.Title,
+		Description: nfo.Plot,
+		Tags:        append(nfo.Tags, nfo.Genres...),
+		Thumbnail:   nfo.Thumb,
+	}
+	if sidecar.Description == "" {
+		sidecar.Description = nfo.Outline
+	}
+	for _, date := range []string{nfo.Premiered, nfo.Aired, nfo.Year} {
+		if date != "" {
+			sidecar.OriginallyPublishedAt = date
+			break
+		}
+	}
+	return sidecar, nil
+}
+
+// applySidecar overrides the fields of media that the sidecar sets. Relative
+// paths in the sidecar are relative to the sidecar itself.
+func applySidecar(media *model.Media, sidecar *Sidecar, sidecarPath string) {
+	dir := filepath.Dir(sidecarPath)
+	resolve := func(p string) string {
+		if p == "" || filepath.IsAbs(p) || strings.Contains(p, "://") {
+			return p
+		}
+		return filepath.Join(dir, p)
+	}
+
+	if sidecar.Title != "" {
+		media.Title = sidecar.Title
+	}
+	if sidecar.Description != "" {
+		media.Description = sidecar.Description
+	}
+	if len(sidecar.Tags) > 0 {
+		media.Tags = normalizeTags(sidecar.Tags)
+	}
+	if sidecar.Category > 0 {
+		media.Category = sidecar.Category
+	}
+	if sidecar.Language != "" {
+		media.Language = sidecar.Language
+	}
+	if sidecar.Licence > 0 {
+		media.Licence = sidecar.Licence
+	}
+	if sidecar.Privacy > 0 {
+		media.Privacy = sidecar.Privacy
+	}
+	if sidecar.OriginallyPublishedAt != "" {
+		date, err := parseDate(sidecar.OriginallyPublishedAt)
+		if err != nil {
+			logger.LogWarning("not able to parse date in sidecar", map[string]interface{}{"sidecar": sidecarPath, "date": sidecar.OriginallyPublishedAt})
+		} else {
+			if media.DateCandidates == nil {
+				media.DateCandidates = map[string]time.Time{}
+			}
+			media.DateCandidates[DateSourceSidecar] = date
+		}
+	}
+	if sidecar.Thumbnail != "" {
+		media.ThumbnailPath = resolve(sidecar.Thumbnail)
+	}
+	if sidecar.Channel != "" {
+		media.Channel = sidecar.Channel
+		media.ChannelRouted = false
+	}
+	if sidecar.Playlist != "" {
+		media.Playlist = sidecar.Playlist
+		media.PlaylistRouted = false
+	}
+	if sidecar.PlaylistPosition > 0 {
+		media.PlaylistPosition = sidecar.PlaylistPosition
+	}
+	if len(sidecar.Destinations) > 0 {
+		media.Destinations = sidecar.Destinations
+	}
+	for _, caption := range sidecar.Captions {
+		media.Captions = append(media.Captions, model.Caption{
+			Language: caption.Language,
+			Path:     resolve(caption.Path),
+		})
+	}
+}
+
+var dateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05-0700",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+	"2006",
+}
+
+func parseDate(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unknown date format %q", value)
+}
@@ -0,0 +1,84 @@
+package media
+
+import (
+	"os"
+	"path/filepath"
+	"peertubeupload/config"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseDate(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{"2021-03-04T05:06:07Z", time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC), false},
+		{"2021-03-04T05:06:07+02:00", time.Date(2021, 3, 4, 3, 6, 7, 0, time.UTC), false},
+		{"2021-03-04T05:06:07+0200", time.Date(2021, 3, 4, 3, 6, 7, 0, time.UTC), false},
+		{"2021-03-04T05:06:07", time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC), false},
+		{"2021-03-04 05:06:07", time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC), false},
+		{" 2021-03-04 ", time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC), false},
+		{"2021", time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), false},
+		{"04/03/2021", time.Time{}, true},
+		{"", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseDate(tt.value)
+		if (err != nil) != tt.wantErr || !got.Equal(tt.want) {
+			t.Errorf("parseDate(%q) = %v, %v, want %v, error %v", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestMediaFromFolderReadsSidecar(t *testing.T) {
+	tests := []struct {
+		name    string
+		sidecar string
+	}{
+		{"movie.mp4.json", `{"title": "Concert", "description": "Live in the park", "tags": ["music", "live"], "thumbnail": "cover.jpg"}`},
+		{"movie.json", `{"title": "Concert", "description": "Live in the park", "tags": ["music", "live"], "thumbnail": "cover.jpg"}`},
+		{"movie.yaml", "title: Concert\ndescription: Live in the park\ntags: [music, live]\nthumbnail: cover.jpg\n"},
+		{"movie.nfo", "<movie><title>Concert</title><plot>Live in the park</plot><tag>music</tag><genre>live</genre><thumb>cover.jpg</thumb></movie>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "movie.mp4")
+			if err := os.WriteFile(path, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, tt.name), []byte(tt.sidecar), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			media := mediaFromFolder(&config.Config{}, path)
+			if media.Title != "Concert" || media.Description != "Live in the park" {
+				t.Errorf("title, description = %q, %q, want the ones of the sidecar", media.Title, media.Description)
+			}
+			if !reflect.DeepEqual(media.Tags, []string{"music", "live"}) {
+				t.Errorf("tags = %q, want music and live", media.Tags)
+			}
+			// paths in the sidecar are relative to it
+			if media.ThumbnailPath != filepath.Join(dir, "cover.jpg") {
+				t.Errorf("thumbnail = %q, want cover.jpg next to the sidecar", media.ThumbnailPath)
+			}
+		})
+	}
+}
+
+func TestMediaFromFolderWithoutSidecar(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "movie.mp4")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := &config.Config{}
+	c.FolderConfig.Description = "Uploaded from the archive"
+
+	media := mediaFromFolder(c, path)
+	if media.Title != "movie" || media.Description != "Uploaded from the archive" {
+		t.Errorf("title, description = %q, %q, want the file name and the folderConfig description", media.Title, media.Description)
+	}
+}
@@ -0,0 +1,406 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"peertubeupload/config"
+	"peertubeupload/logger"
+	"peertubeupload/medialog"
+	"peertubeupload/model"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// SyncEntry is one field of an uploaded video that differs from its row.
+type SyncEntry struct {
+	Key         string `json:"key"`
+	Destination string `json:"destination,omitempty"`
+	UUID        string `json:"uuid"`
+	Field       string `json:"field"`
+	Remote      string `json:"remote"`
+	Source      string `json:"source"`
+	Status      string `json:"status"`
+	Error       string `json:"error,omitempty"`
+}
+
+const (
+	syncUpdated = "updated"
+	syncPending = "dry run"
+	syncFailed  = "failed"
+)
+
+// syncedVideo is a row of the source table joined with its log row.
+type syncedVideo struct {
+	key         string
+	destination string
+	video       model.VideoClass
+	fields      syncFields
+}
+
+// syncFields are the metadata sync-metadata keeps up to date. Empty values
+// come from unmapped or empty columns and are left alone on the instance.
+type syncFields struct {
+	Name        string
+	Description string
+	Tags        []string
+	Privacy     int
+	Category    int
+}
+
+type remoteVideo struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Tags        []string `json:"tags"`
+	Privacy     struct {
+		ID int `json:"id"`
+	} `json:"privacy"`
+	Category struct {
+		ID *int `json:"id"`
+	} `json:"category"`
+}
+
+// SyncMetadata compares every row of dbConfig.tableName that was uploaded
+// with its video on the instance and sends PUT /videos/{id} with the fields
+// that changed: name, description, tags, privacy and category. With dryRun
+// nothing is sent. The differences are written to report as JSON or CSV,
+// depending on its extension, or logged without a report.
+func SyncMetadata(ctx context.Context, db *sql.DB, c *config.Config, destinations []Destination, report string, dryRun bool) error {
+	if !c.LoadType.LoadPathFromDB {
+		return fmt.Errorf("sync-metadata needs loadType.loadPathFromDB, the log table is what ties rows to videos")
+	}
+	videos, err := loadSyncedVideos(db, c)
+	if err != nil {
+		return err
+	}
+	byName := map[string]*Destination{}
+	for i := range destinations {
+		if destinations[i].LoginErr == nil {
+			byName[strings.ToLower(destinations[i].Name)] = &destinations[i]
+		}
+	}
+
+	var mutex sync.Mutex
+	var entries []SyncEntry
+	threads := int64(c.ProccessConfig.Threads)
+	if threads < 1 {
+		threads = 1
+	}
+	sem := semaphore.NewWeighted(threads)
+	for _, v := range videos {
+		if sem.Acquire(ctx, 1) != nil {
+			break
+		}
+		go func(v syncedVideo) {
+			defer sem.Release(1)
+			d, ok := byName[strings.ToLower(v.destination)]
+			if !ok {
+				logger.LogWarning("destination of the logged video is not configured or not logged in, skipping it", map[string]interface{}{"key": v.key, "destination": v.destination})
+				return
+			}
+			found := syncVideo(d, v, dryRun)
+			mutex.Lock()
+			entries = append(entries, found...)
+			mutex.Unlock()
+		}(v)
+	}
+	// wait for the videos in progress, even after a shutdown
+	_ = sem.Acquire(context.Background(), threads)
+	return writeSyncReport(entries, report)
+}
+
+// loadSyncedVideos joins the source table with its log table on the media
+// identifier columns.
+func loadSyncedVideos(db *sql.DB, c *config.Config) ([]syncedVideo, error) {
+	idColumn := ""
+	for _, column := range medialog.ReferenceColumns(c) {
+		switch strings.ToLower(column) {
+		case "peertube_id":
+			idColumn = "peertube_id"
+		case "uuid":
+			if idColumn == "" {
+				idColumn = "uuid"
+			}
+		}
+	}
+	if idColumn == "" {
+		return nil, fmt.Errorf("log table %s needs a peertube_id or uuid reference column to find uploaded media", medialog.LogTableName(c))
+	}
+	if len(c.DBConfig.MediaIdentifier) == 0 {
+		return nil, fmt.Errorf("dbConfig.media_identifier is needed to join the table with its log")
+	}
+
+	var sourceColumns []string
+	for _, column := range append([]string{c.DBConfig.Title, c.DBConfig.Description, c.DBConfig.Tags, c.DBConfig.Privacy, c.DBConfig.Category}, c.DBConfig.MediaIdentifier...) {
+		if column != "" {
+			sourceColumns = append(sourceColumns, column)
+		}
+	}
+	selected := make([]string, 0, len(sourceColumns)+2)
+	for _, column := range sourceColumns {
+		selected = append(selected, "s."+column)
+	}
+	selected = append(selected, "l."+idColumn+" AS log_id")
+	hasDestination := len(c.Destinations) > 0
+	if hasDestination {
+		selected = append(selected, "l."+medialog.DestinationColumn+" AS log_destination")
+	}
+	hasState := c.VerificationConfig.Enabled
+	if hasState {
+		selected = append(selected, "l."+medialog.StateColumn+" AS log_state")
+	}
+	// the log table stores every column as text, whatever the source type
+	varchar := "VARCHAR(255)"
+	if c.DBConfig.DBType == "oracle" {
+		varchar = "VARCHAR2(255)"
+	}
+	var join []string
+	for _, column := range c.DBConfig.MediaIdentifier {
+		join = append(join, fmt.Sprintf("CAST(s.%s AS %s) = l.%s", column, varchar, column))
+	}
+
+	rows, err := db.Query(fmt.Sprintf("SELECT %s FROM %s s JOIN %s l ON %s",
+		strings.Join(selected, ", "), c.DBConfig.TableName, medialog.LogTableName(c), strings.Join(join, " AND ")))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fallback := config.DefaultDestination
+	if destinations, err := c.UploadDestinations(); err == nil && len(destinations) > 0 {
+		fallback = destinations[0].Name
+	}
+	values := make([]interface{}, len(selected))
+	valuePtrs := make([]interface{}, len(selected))
+	for i := range values {
+		valuePtrs[i] = &values[i]
+	}
+
+	var videos []syncedVideo
+	seen := map[string]bool{}
+	for rows.Next() {
+		if err := rows.Scan(valuePtrs...); err != nil {
+			return nil, err
+		}
+		row := map[string]interface{}{}
+		for i, column := range sourceColumns {
+			row[column] = values[i]
+		}
+		v := syncedVideo{
+			key:         medialog.RowKey(c, row),
+			destination: fallback,
+			fields: syncFields{
+				Name:        columnString(row, c.DBConfig.Title),
+				Description: columnString(row, c.DBConfig.Description),
+				Tags:        normalizeTags(strings.Split(columnString(row, c.DBConfig.Tags), ",")),
+				Privacy:     columnInt(row, c.DBConfig.Privacy),
+				Category:    columnInt(row, c.DBConfig.Category),
+			},
+		}
+		id := valueString(values[len(sourceColumns)])
+		if id == "" {
+			continue
+		}
+		if idColumn == "uuid" {
+			v.video.UUID = id
+		} else {
+			v.video.ID, _ = strconv.ParseInt(id, 10, 64)
+		}
+		if hasDestination {
+			if name := valueString(values[len(sourceColumns)+1]); name != "" {
+				v.destination = name
+			}
+		}
+		// a video that failed verification is uploaded again, its row is
+		// synced with the new video
+		if hasState && valueString(values[len(selected)-1]) == model.VerificationFailed {
+			continue
+		}
+		// a row logged twice, after a failed verification, is synced once
+		if seen[v.destination+"|"+id] {
+			continue
+		}
+		seen[v.destination+"|"+id] = true
+		videos = append(videos, v)
+	}
+	return videos, rows.Err()
+}
+
+// syncVideo compares v with its video on d and updates the fields that
+// differ, unless dryRun.
+func syncVideo(d *Destination, v syncedVideo, dryRun bool) []SyncEntry {
+	entry := SyncEntry{Key: v.key, Destination: v.destination, UUID: v.video.UUID}
+	if entry.UUID == "" {
+		entry.UUID = videoID(v.video)
+	}
+
+	var remote remoteVideo
+	if err := getJSON(d.API, fmt.Sprintf("%s/videos/%s", d.API.BaseURL, videoID(v.video)), &remote); err != nil {
+		logger.LogError("not able to read the video from the instance", map[string]interface{}{"error": err, "key": v.key, "uuid": entry.UUID, "destination": v.destination})
+		entry.Status, entry.Error = syncFailed, err.Error()
+		return []SyncEntry{entry}
+	}
+
+	changes, entries := diffVideo(v.fields, remote, entry)
+	if len(changes) == 0 || dryRun {
+		return entries
+	}
+
+	status, message := syncUpdated, ""
+	if err := updateVideo(d, v.video, changes); err != nil {
+		logger.LogError("not able to update the video", map[string]interface{}{"error": err, "key": v.key, "uuid": entry.UUID, "destination": v.destination})
+		status, message = syncFailed, err.Error()
+	} else {
+		logger.LogInfo("Video metadata synced", map[string]interface{}{"key": v.key, "uuid": entry.UUID, "destination": v.destination, "fields": len(changes)})
+	}
+	for i := range entries {
+		entries[i].Status, entries[i].Error = status, message
+	}
+	return entries
+}
+
+// diffVideo returns the fields to send to bring remote in line with source,
+// and a report entry per field, based on entry.
+func diffVideo(source syncFields, remote remoteVideo, entry SyncEntry) (map[string]interface{}, []SyncEntry) {
+	changes := map[string]interface{}{}
+	var entries []SyncEntry
+	add := func(field string, value interface{}, before string, after string) {
+		changes[field] = value
+		e := entry
+		e.Field, e.Remote, e.Source, e.Status = field, before, after, syncPending
+		entries = append(entries, e)
+	}
+
+	if source.Name != "" && source.Name != remote.Name {
+		add("name", source.Name, remote.Name, source.Name)
+	}
+	if source.Description != "" && source.Description != remote.Description {
+		add("description", source.Description, remote.Description, source.Description)
+	}
+	if len(source.Tags) > 0 && !sameTags(source.Tags, remote.Tags) {
+		add("tags", source.Tags, strings.Join(remote.Tags, ","), strings.Join(source.Tags, ","))
+	}
+	if source.Privacy > 0 && source.Privacy != remote.Privacy.ID {
+		add("privacy", source.Privacy, strconv.Itoa(remote.Privacy.ID), strconv.Itoa(source.Privacy))
+	}
+	if source.Category > 0 && (remote.Category.ID == nil || source.Category != *remote.Category.ID) {
+		before := ""
+		if remote.Category.ID != nil {
+			before = strconv.Itoa(*remote.Category.ID)
+		}
+		add("category", source.Category, before, strconv.Itoa(source.Category))
+	}
+	return changes, entries
+}
+
+// sameTags compares tags regardless of order and case, as PeerTube does.
+func sameTags(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	normalize := func(tags []string) []string {
+		lower := make([]string, len(tags))
+		for i, tag := range tags {
+			lower[i] = strings.ToLower(tag)
+		}
+		sort.Strings(lower)
+		return lower
+	}
+	x, y := normalize(a), normalize(b)
+	for i := range x {
+		if x[i] != y[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// updateVideo sends changes through PUT /videos/{id}, as the multipart form
+// the endpoint takes.
+func updateVideo(d *Destination, video model.VideoClass, changes map[string]interface{}) error {
+	payload := &bytes.Buffer{}
+	writer := multipart.NewWriter(payload)
+	if err := writeFields(writer, changes); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	res, err := d.API.Do(func() (*http.Request, error) {
+		req, err := http.NewRequest("PUT", fmt.Sprintf("%s/videos/%s", d.API.BaseURL, videoID(video)), bytes.NewReader(payload.Bytes()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK {
+		return fmt.Errorf("video update returned %s: %s", res.Status, body)
+	}
+	return nil
+}
+
+// writeSyncReport prints a summary and saves the entries to report as JSON
+// or CSV, depending on its extension. Without a report every entry is
+// logged.
+func writeSyncReport(entries []SyncEntry, report string) error {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Key != entries[j].Key {
+			return entries[i].Key < entries[j].Key
+		}
+		if entries[i].Destination != entries[j].Destination {
+			return entries[i].Destination < entries[j].Destination
+		}
+		return entries[i].Field < entries[j].Field
+	})
+
+	counts := map[string]int{}
+	for _, entry := range entries {
+		counts[entry.Status]++
+		if report == "" {
+			logger.LogInfo("Metadata difference", map[string]interface{}{"key": entry.Key, "destination": entry.Destination, "uuid": entry.UUID, "field": entry.Field, "remote": entry.Remote, "source": entry.Source, "status": entry.Status, "error": entry.Error})
+		}
+	}
+	logger.LogInfo("Metadata sync finished", map[string]interface{}{"updated": counts[syncUpdated], "dryRun": counts[syncPending], "failed": counts[syncFailed]})
+
+	if report == "" {
+		return nil
+	}
+	file, err := os.Create(report)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if strings.ToLower(filepath.Ext(report)) == ".json" {
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", " ")
+		return encoder.Encode(entries)
+	}
+
+	w := csv.NewWriter(file)
+	_ = w.Write([]string{"key", "destination", "uuid", "field", "remote", "source", "status", "error"})
+	for _, e := range entries {
+		_ = w.Write([]string{e.Key, e.Destination, e.UUID, e.Field, e.Remote, e.Source, e.Status, e.Error})
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,138 @@
+package media
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"peertubeupload/apiclient"
+	"peertubeupload/login"
+	"peertubeupload/model"
+	"reflect"
+	"testing"
+)
+
+func TestSameTags(t *testing.T) {
+	tests := []struct {
+		a, b []string
+		want bool
+	}{
+		{[]string{"music", "live"}, []string{"Live", "MUSIC"}, true},
+		{nil, nil, true},
+		{[]string{"music"}, []string{"music", "live"}, false},
+		{[]string{"music", "news"}, []string{"music", "live"}, false},
+	}
+	for _, tt := range tests {
+		if got := sameTags(tt.a, tt.b); got != tt.want {
+			t.Errorf("sameTags(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestDiffVideo(t *testing.T) {
+	var remote remoteVideo
+	remote.Name = "Old title"
+	remote.Description = "Same"
+	remote.Tags = []string{"Music"}
+	remote.Privacy.ID = 1
+	category := 10
+	remote.Category.ID = &category
+
+	tests := []struct {
+		name   string
+		source syncFields
+		want   map[string]interface{}
+	}{
+		{"nothing mapped", syncFields{}, map[string]interface{}{}},
+		{"unchanged", syncFields{Name: "Old title", Description: "Same", Tags: []string{"music"}, Privacy: 1, Category: 10}, map[string]interface{}{}},
+		{"name", syncFields{Name: "New title"}, map[string]interface{}{"name": "New title"}},
+		{"tags and privacy", syncFields{Tags: []string{"music", "live"}, Privacy: 3}, map[string]interface{}{"tags": []string{"music", "live"}, "privacy": 3}},
+		{"category", syncFields{Category: 2}, map[string]interface{}{"category": 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changes, entries := diffVideo(tt.source, remote, SyncEntry{Key: "row", UUID: "uuid"})
+			if !reflect.DeepEqual(changes, tt.want) {
+				t.Errorf("changes = %v, want %v", changes, tt.want)
+			}
+			if len(entries) != len(tt.want) {
+				t.Fatalf("%d report entries, want %d", len(entries), len(tt.want))
+			}
+			for _, e := range entries {
+				if e.Key != "row" || e.UUID != "uuid" || e.Status != syncPending {
+					t.Errorf("entry %+v doesn't carry the row and pending status", e)
+				}
+			}
+		})
+	}
+
+	// a video without a category gets the one of the row
+	remote.Category.ID = nil
+	changes, entries := diffVideo(syncFields{Category: 10}, remote, SyncEntry{})
+	if changes["category"] != 10 || entries[0].Remote != "" {
+		t.Errorf("changes = %v, entries = %+v, want category 10 from nothing", changes, entries)
+	}
+}
+
+// videoServer serves the video "uploaded" as remote and records the fields
+// of the PUT that updates it.
+func videoServer(t *testing.T, remote string) (*Destination, *url.Values) {
+	updated := &url.Values{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/videos/uploaded" {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.Method {
+		case "GET":
+			fmt.Fprint(w, remote)
+		case "PUT":
+			if err := r.ParseMultipartForm(1 << 20); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			*updated = url.Values(r.MultipartForm.Value)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	t.Cleanup(server.Close)
+	api := apiclient.New(server.Client(), &login.LoginManager{}, nil, server.URL+"/api/v1", "alice", "")
+	return &Destination{API: api}, updated
+}
+
+func TestSyncVideoSendsChangedFields(t *testing.T) {
+	d, updated := videoServer(t, `{"name": "Old title", "description": "Same", "tags": ["music"], "privacy": {"id": 1}, "category": {"id": null}}`)
+	v := syncedVideo{
+		key:         "42",
+		destination: "main",
+		video:       model.VideoClass{ID: 5, UUID: "uploaded"},
+		fields:      syncFields{Name: "New title", Description: "Same", Tags: []string{"Music", "live"}, Privacy: 1},
+	}
+
+	entries := syncVideo(d, v, false)
+	if len(entries) != 2 {
+		t.Fatalf("entries = %+v, want the name and the tags", entries)
+	}
+	for _, e := range entries {
+		if e.Status != syncUpdated || e.Key != "42" || e.Destination != "main" {
+			t.Errorf("entry = %+v, want it updated for row 42 on main", e)
+		}
+	}
+	want := url.Values{"name": {"New title"}, "tags[]": {"Music", "live"}}
+	if !reflect.DeepEqual(*updated, want) {
+		t.Errorf("PUT sent %v, want %v", *updated, want)
+	}
+}
+
+func TestSyncVideoDryRunSendsNothing(t *testing.T) {
+	d, updated := videoServer(t, `{"name": "Old title", "privacy": {"id": 1}, "category": {"id": 3}}`)
+	v := syncedVideo{key: "42", video: model.VideoClass{UUID: "uploaded"}, fields: syncFields{Name: "New title", Category: 3}}
+
+	entries := syncVideo(d, v, true)
+	if len(entries) != 1 || entries[0].Field != "name" || entries[0].Status != syncPending {
+		t.Errorf("entries = %+v, want the name pending", entries)
+	}
+	if len(*updated) != 0 {
+		t.Errorf("dry run sent %v", *updated)
+	}
+}
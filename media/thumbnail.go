@@ -0,0 +1,224 @@
+package media
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"peertubeupload/apiclient"
+	"peertubeupload/config"
+	"peertubeupload/logger"
+	"peertubeupload/model"
+	"strconv"
+	"strings"
+)
+
+var imageExtensions = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".webp": true,
+}
+
+// findThumbnailFile looks for an image next to mediaPath named after it,
+// movie.jpg or movie-thumb.jpg for movie.mp4.
+func findThumbnailFile(mediaPath string) string {
+	withoutExt := strings.TrimSuffix(mediaPath, filepath.Ext(mediaPath))
+	for _, suffix := range []string{"", "-thumb", "-poster", ".thumb"} {
+		for _, ext := range []string{".jpg", ".jpeg", ".png", ".webp"} {
+			candidate := withoutExt + suffix + ext
+			if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+				return candidate
+			}
+		}
+	}
+	return ""
+}
+
+// thumbnailFor picks the image for media: the path from the sidecar or DB
+// column, an image next to the file, then the cover art for audio or a frame
+// grabbed with ffmpeg for video. Extracted images are temporary files the
+// caller removes.
+func thumbnailFor(c *config.Config, media model.Media) (path string, temporary bool, err error) {
+	if media.ThumbnailPath != "" {
+		if strings.Contains(media.ThumbnailPath, "://") {
+			logger.LogWarning("thumbnail URLs are not supported, looking for another thumbnail", map[string]interface{}{"thumbnail": media.ThumbnailPath})
+		} else if !imageExtensions[strings.ToLower(filepath.Ext(media.ThumbnailPath))] {
+			logger.LogWarning("thumbnail is not a jpg, png or webp image, looking for another thumbnail", map[string]interface{}{"thumbnail": media.ThumbnailPath})
+		} else {
+			return media.ThumbnailPath, false, nil
+		}
+	}
+	// imports get the thumbnail PeerTube makes from the fetched file
+	if importField(media.FilePath) != "" {
+		return "", false, nil
+	}
+	if found := findThumbnailFile(media.FilePath); found != "" {
+		return found, false, nil
+	}
+	metadata, err := getMetaData(media.FilePath)
+	if err != nil {
+		return "", false, err
+	}
+	if isVideo, isAudio := streamKinds(metadata); !isVideo && isAudio {
+		return audioThumbnail(c, media.FilePath, metadata)
+	}
+	if c.ThumbnailConfig.GenerateFrame {
+		path, err := grabFrame(c, media.FilePath, metadata)
+		return path, err == nil, err
+	}
+	return "", false, nil
+}
+
+// streamKinds reports whether the file has video and audio streams. Cover
+// art is stored as a video stream flagged attached_pic and doesn't count.
+func streamKinds(metadata model.Metadata) (isVideo bool, isAudio bool) {
+	for _, stream := range metadata.Streams {
+		if stream.CodecType == "video" && stream.Disposition["attached_pic"] == 0 {
+			isVideo = true
+		}
+		if stream.CodecType == "audio" {
+			isAudio = true
+		}
+	}
+	return isVideo, isAudio
+}
+
+// audioThumbnail extracts the cover art of an audio file, or falls back to
+// thumbnailConfig.defaultAudioImage. An extracted cover is temporary.
+func audioThumbnail(c *config.Config, mediaPath string, metadata model.Metadata) (path string, temporary bool, err error) {
+	for _, stream := range metadata.Streams {
+		if stream.CodecType != "video" || stream.Disposition["attached_pic"] == 0 {
+			continue
+		}
+		path, err := extractCoverArt(c, mediaPath, stream)
+		if err != nil {
+			logger.LogWarning("not able to extract cover art", map[string]interface{}{"error": err, "file": mediaPath})
+			break
+		}
+		return path, true, nil
+	}
+	return c.ThumbnailConfig.DefaultAudioImage, false, nil
+}
+
+func extractCoverArt(c *config.Config, mediaPath string, stream model.Stream) (string, error) {
+	out, err := tempFilePath(c, GetFileName(mediaPath)+".*.cover.jpg")
+	if err != nil {
+		return "", err
+	}
+	cmd := exec.Command("ffmpeg", "-v", "error", "-y", "-i", mediaPath, "-map", fmt.Sprintf("0:%d", stream.Index), "-frames:v", "1", out)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		os.Remove(out)
+		return "", fmt.Errorf("ffmpeg failed to extract cover art: %w: %s", err, stderr.String())
+	}
+	return out, nil
+}
+
+// grabFrame writes one frame of the video to loadType.tempFolder, taken at
+// thumbnailConfig.framePercent of the duration or frameOffset seconds in.
+func grabFrame(c *config.Config, mediaPath string, metadata model.Metadata) (string, error) {
+	offset := c.ThumbnailConfig.FrameOffset
+	if duration, err := strconv.ParseFloat(metadata.Format.Duration, 64); err == nil && duration > 0 {
+		if c.ThumbnailConfig.FramePercent > 0 {
+			offset = duration * c.ThumbnailConfig.FramePercent / 100
+		}
+		// an offset past the end gives no frame at all
+		if offset >= duration {
+			offset = duration / 2
+		}
+	}
+
+	out, err := tempFilePath(c, GetFileName(mediaPath)+".*.thumbnail.jpg")
+	if err != nil {
+		return "", err
+	}
+	cmd := exec.Command("ffmpeg", "-v", "error", "-y", "-ss", strconv.FormatFloat(offset, 'f', 3, 64), "-i", mediaPath, "-frames:v", "1", "-q:v", "2", out)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		os.Remove(out)
+		return "", fmt.Errorf("ffmpeg failed to grab frame: %w: %s", err, stderr.String())
+	}
+	return out, nil
+}
+
+// uploadThumbnail sets the thumbnail and preview of the uploaded video. A
+// failure is logged, the video stays with the image PeerTube picked.
+func uploadThumbnail(c *config.Config, api *apiclient.Client, video model.VideoClass, media model.Media) {
+	if !c.ThumbnailConfig.Enabled {
+		return
+	}
+	path, temporary, err := thumbnailFor(c, media)
+	if err != nil {
+		logger.LogWarning("not able to get a thumbnail", map[string]interface{}{"error": err, "file": media.FilePath})
+		return
+	}
+	if path == "" {
+		return
+	}
+	if temporary {
+		defer os.Remove(path)
+	}
+
+	if err := updateVideoImages(api, video, path); err != nil {
+		logger.LogError("not able to set thumbnail", map[string]interface{}{"error": err, "thumbnail": path, "uuid": video.UUID})
+		return
+	}
+	logger.LogInfo("Thumbnail set", map[string]interface{}{"thumbnail": path, "uuid": video.UUID})
+}
+
+// updateVideoImages sends imagePath as both thumbnailfile and previewfile
+// through PUT /videos/{id}.
+func updateVideoImages(api *apiclient.Client, video model.VideoClass, imagePath string) error {
+	payload := &bytes.Buffer{}
+	writer := multipart.NewWriter(payload)
+	if err := addImageParts(writer, imagePath); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	res, err := api.Do(func() (*http.Request, error) {
+		req, err := http.NewRequest("PUT", fmt.Sprintf("%s/videos/%s", api.BaseURL, video.UUID), bytes.NewReader(payload.Bytes()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK {
+		return fmt.Errorf("video update returned %s: %s", res.Status, body)
+	}
+	return nil
+}
+
+// addImageParts adds imagePath to a multipart form as both thumbnailfile and
+// previewfile.
+func addImageParts(writer *multipart.Writer, imagePath string) error {
+	image, err := os.ReadFile(imagePath)
+	if err != nil {
+		return err
+	}
+	for _, field := range []string{"thumbnailfile", "previewfile"} {
+		part, err := writer.CreateFormFile(field, filepath.Base(imagePath))
+		if err != nil {
+			return err
+		}
+		if _, err := part.Write(image); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"peertubeupload/apiclient"
+	"peertubeupload/config"
+	"peertubeupload/logger"
+	"peertubeupload/model"
+	"time"
+)
+
+// defaultVerificationTimeout is, in minutes, how long an unset
+// verificationConfig.timeout lets a video transcode before it counts as timed
+// out.
+const defaultVerificationTimeout = 60
+
+// States of a video on PeerTube that verification cares about.
+const (
+	videoPublished              = 1
+	videoTranscodingFailed      = 7
+	videoMoveToExternalFailed   = 8
+	videoMoveToFileSystemFailed = 11
+)
+
+type videoFile struct {
+	Resolution struct {
+		ID    int    `json:"id"`
+		Label string `json:"label"`
+	} `json:"resolution"`
+}
+
+type videoDetails struct {
+	State struct {
+		ID    int    `json:"id"`
+		Label string `json:"label"`
+	} `json:"state"`
+	Duration           int         `json:"duration"`
+	Files              []videoFile `json:"files"`
+	StreamingPlaylists []struct {
+		Files []videoFile `json:"files"`
+	} `json:"streamingPlaylists"`
+}
+
+// resolutions lists the resolutions of the web videos and HLS files, highest
+// first as PeerTube sorts them, without duplicates.
+func (d videoDetails) resolutions() []string {
+	var labels []string
+	seen := map[int]bool{}
+	files := append([]videoFile{}, d.Files...)
+	for _, playlist := range d.StreamingPlaylists {
+		files = append(files, playlist.Files...)
+	}
+	for _, file := range files {
+		if seen[file.Resolution.ID] {
+			continue
+		}
+		seen[file.Resolution.ID] = true
+		labels = append(labels, file.Resolution.Label)
+	}
+	return labels
+}
+
+// verifyVideo polls GET /videos/{id} every verificationConfig.pollInterval
+// seconds until the video is published, fails to transcode, or
+// verificationConfig.timeout minutes went by, a timeout of 0 or less keeps
+// polling until the video is done either way. The returned verification is
+// set in every case but a cancelled ctx, the error tells whether the video
+// didn't make it.
+func verifyVideo(ctx context.Context, c *config.Config, api *apiclient.Client, video model.VideoClass) (*model.Verification, error) {
+	interval := time.Duration(c.VerificationConfig.PollInterval) * time.Second
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	timeout := defaultVerificationTimeout
+	if c.VerificationConfig.Timeout != nil {
+		timeout = *c.VerificationConfig.Timeout
+	}
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(time.Duration(timeout) * time.Minute)
+	}
+	var details videoDetails
+	for {
+		if err := getJSON(api, fmt.Sprintf("%s/videos/%s", api.BaseURL, videoID(video)), &details); err != nil {
+			logger.LogWarning("not able to check the video state, trying again", map[string]interface{}{"error": err, "uuid": video.UUID})
+		} else {
+			verification := &model.Verification{
+				Label:       details.State.Label,
+				Duration:    details.Duration,
+				Resolutions: details.resolutions(),
+			}
+			switch details.State.ID {
+			case videoPublished:
+				verification.State = model.VerificationPublished
+				return verification, nil
+			case videoTranscodingFailed, videoMoveToExternalFailed, videoMoveToFileSystemFailed:
+				verification.State = model.VerificationFailed
+				return verification, fmt.Errorf("video %s is in state %q", video.UUID, details.State.Label)
+			}
+		}
+
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return &model.Verification{
+				State:       model.VerificationTimeout,
+				Label:       details.State.Label,
+				Duration:    details.Duration,
+				Resolutions: details.resolutions(),
+			}, fmt.Errorf("video %s not published within %d minutes", video.UUID, timeout)
+		}
+		if err := sleepContext(ctx, interval); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// discardFailedVideo deletes a video that failed to transcode, with
+// verificationConfig.deleteFailed, so retrying the upload doesn't leave a
+// broken copy behind on the instance.
+func discardFailedVideo(t *target, video model.VideoClass) {
+	if err := sendJSON(t.API, "DELETE", fmt.Sprintf("%s/videos/%s", t.API.BaseURL, videoID(video)), "", nil, nil); err != nil {
+		logger.LogWarning("not able to delete the failed video, remove it by hand", map[string]interface{}{"error": err, "uuid": video.UUID, "destination": t.Name})
+		return
+	}
+	logger.LogInfo("Failed video deleted", map[string]interface{}{"uuid": video.UUID, "destination": t.Name})
+}
@@ -1,7 +1,6 @@
 package media
 
 import (
-	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -16,6 +15,7 @@ The original code can be found at: https://github.com/FiskFan1999/peertube-multi
 type VideoFileByteCounter int64
 
 const (
+	// VideoChunkSize is used when processConfig doesn't set a chunk size.
 	VideoChunkSize VideoFileByteCounter = 1024 * 1024 * 500
 )
 
@@ -54,16 +54,19 @@ func GetVideoFileReader(filename string, chunkSize VideoFileByteCounter) (vfr *V
 	*/
 	vfr.CurrentMinBytes = 0
 	vfr.ChunkSize = chunkSize
+	if vfr.ChunkSize <= 0 {
+		vfr.ChunkSize = VideoChunkSize
+	}
 
 	return
 }
 
 type VFRCurrentChunk struct {
-	Bytes       []byte
+	Reader      *io.SectionReader
 	RangeHeader string
 	MinByte     VideoFileByteCounter
 	MaxByte     VideoFileByteCounter
-	Length      int
+	Length      int64
 	Finished    bool
 }
 
@@ -90,35 +93,45 @@ func GetFileSize(filename string) (int64, error) {
 	return file.Size(), nil // size in bytes
 }
 
+// SeekTo moves the reader to offset so the next chunk starts there, used when
+// resuming a session the server already holds part of.
+func (vfr *VideoFileReader) SeekTo(offset VideoFileByteCounter) error {
+	if offset < 0 || offset > vfr.TotalBytes {
+		return fmt.Errorf("offset %d is outside of file of %d bytes", offset, vfr.TotalBytes)
+	}
+	vfr.CurrentMinBytes = offset
+	return nil
+}
+
+func (vfr *VideoFileReader) Close() error {
+	return vfr.VideoFile.Close()
+}
+
+// GetNextChunk returns a window over the next ChunkSize bytes of the file.
+// Nothing is read into memory here, the chunk's Reader streams straight from
+// disk when the request body is sent.
 func (vfr *VideoFileReader) GetNextChunk() (res *VFRCurrentChunk, err error) {
 	res = new(VFRCurrentChunk)
 	res.MinByte = vfr.CurrentMinBytes
-	res.Bytes = make([]byte, vfr.ChunkSize)
-	numBytes, err := vfr.VideoFile.Read(res.Bytes)
-	if numBytes != len(res.Bytes) {
-		newB := make([]byte, numBytes)
-		for i := range newB {
-			newB[i] = res.Bytes[i]
-		}
-		res.Bytes = newB
-	}
-	if errors.Is(err, io.EOF) {
+	if res.MinByte >= vfr.TotalBytes {
 		/*
 			Previous iteration read all the way to EOF.
 		*/
 		res.Finished = true
-		res.MaxByte = res.MinByte // convert int numBytes to int64
+		res.MaxByte = res.MinByte
 		return res, nil
-	} else if err != nil {
-		return
-	} else {
-		res.MaxByte = res.MinByte + VideoFileByteCounter(numBytes) // convert int numBytes to int64
 	}
 
-	res.Length = numBytes
-	res.MaxByte = res.MinByte + VideoFileByteCounter(numBytes) - 1 // convert int numBytes to int64
+	length := vfr.ChunkSize
+	if remaining := vfr.TotalBytes - res.MinByte; remaining < length {
+		length = remaining
+	}
+
+	res.Reader = io.NewSectionReader(vfr.VideoFile, int64(res.MinByte), int64(length))
+	res.Length = int64(length)
+	res.MaxByte = res.MinByte + length - 1
 	res.RangeHeader = fmt.Sprintf("bytes %d-%d/%d", res.MinByte, res.MaxByte, vfr.TotalBytes)
 	res.Finished = false
-	vfr.CurrentMinBytes += VideoFileByteCounter(numBytes)
+	vfr.CurrentMinBytes += length
 	return
 }
@@ -0,0 +1,193 @@
+package media
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"peertubeupload/config"
+	"peertubeupload/logger"
+	"peertubeupload/model"
+	"peertubeupload/state"
+	"sync"
+	"time"
+)
+
+// maxWatchAttempts is how many times a watched file is uploaded before it is
+// left alone until it changes.
+const maxWatchAttempts = 5
+
+type watchedFile struct {
+	size        int64
+	modTime     time.Time
+	stableSince time.Time
+	// attempts counts the failed uploads of this size and mtime, retryAt is
+	// when the next one may start.
+	attempts int
+	retryAt  time.Time
+}
+
+// watchQueue holds the files watchFolder sent for upload, so they aren't
+// sent again while unchanged. A file whose upload failed is sent again after
+// a delay that doubles with each failure, up to maxWatchAttempts tries. A
+// changed file starts over.
+type watchQueue struct {
+	mutex sync.Mutex
+	files map[string]watchedFile
+}
+
+func newWatchQueue() *watchQueue {
+	return &watchQueue{files: map[string]watchedFile{}}
+}
+
+// has reports whether path was queued with the size and mtime of info and
+// isn't due for a retry at now.
+func (q *watchQueue) has(path string, info os.FileInfo, now time.Time) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	w, ok := q.files[path]
+	if !ok || w.size != info.Size() || !w.modTime.Equal(info.ModTime()) {
+		return false
+	}
+	return w.retryAt.IsZero() || now.Before(w.retryAt)
+}
+
+// add queues path, keeping the failed attempts of the same size and mtime.
+func (q *watchQueue) add(path string, w watchedFile) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if prev, ok := q.files[path]; ok && prev.size == w.size && prev.modTime.Equal(w.modTime) {
+		w.attempts = prev.attempts
+	}
+	w.retryAt = time.Time{}
+	q.files[path] = w
+}
+
+// failed records a failed upload of path and schedules the next one, unless
+// it was the last attempt.
+func (q *watchQueue) failed(path string, now time.Time) {
+	if q == nil {
+		return
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	w, ok := q.files[path]
+	if !ok {
+		return
+	}
+	w.attempts++
+	if w.attempts >= maxWatchAttempts {
+		logger.LogError("giving up on the file until it changes", map[string]interface{}{"file": path, "attempts": w.attempts})
+		w.retryAt = time.Time{}
+	} else {
+		w.retryAt = now.Add(watchRetryDelay(w.attempts))
+		logger.LogWarning("upload of the file will be retried", map[string]interface{}{"file": path, "attempts": w.attempts, "retryAt": w.retryAt})
+	}
+	q.files[path] = w
+}
+
+// watchRetryDelay is one minute after the first failure, doubled after each
+// further one, at most an hour.
+func watchRetryDelay(attempts int) time.Duration {
+	delay := time.Minute
+	for i := 1; i < attempts && delay < time.Hour; i++ {
+		delay *= 2
+	}
+	if delay > time.Hour {
+		delay = time.Hour
+	}
+	return delay
+}
+
+// keep forgets the files that are no longer present.
+func (q *watchQueue) keep(present map[string]bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for path := range q.files {
+		if !present[path] {
+			delete(q.files, path)
+		}
+	}
+}
+
+// watchFolder polls folderConfig.path and queues every file once its size and
+// mtime haven't changed for folderConfig.stableFor seconds, so files still
+// being copied in aren't uploaded half written. Polling is used rather than
+// inotify because it also works on network shares. Files the store marks as
+// handled are skipped, so a restart doesn't upload them again, and so are the
+// files in queue. Cancelling ctx stops the watch and closes filesChan.
+func watchFolder(ctx context.Context, c *config.Config, filesChan chan<- model.Media, store *state.Store, queue *watchQueue) {
+	pollInterval := time.Duration(c.FolderConfig.PollInterval) * time.Second
+	if pollInterval <= 0 {
+		pollInterval = 30 * time.Second
+	}
+	stableFor := time.Duration(c.FolderConfig.StableFor) * time.Second
+
+	if store == nil {
+		logger.LogWarning("no stateFile configured, files will be uploaded again after a restart unless skipUploaded is on", nil)
+	}
+	logger.LogInfo("Watching folder for new files", map[string]interface{}{"Path": c.FolderConfig.Path, "pollInterval": pollInterval, "stableFor": stableFor})
+
+	seen := map[string]*watchedFile{}
+	for {
+		now := time.Now()
+		present := map[string]bool{}
+
+		err := filepath.Walk(c.FolderConfig.Path, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				logger.LogError("Error accessing path", map[string]interface{}{"Path": path, "error": err})
+				return nil
+			}
+			if info.IsDir() || !acceptFile(c, info.Name()) {
+				return nil
+			}
+			present[path] = true
+
+			if queue.has(path, info, now) {
+				return nil
+			}
+			if store.IsHandled(path, info) {
+				return nil
+			}
+
+			w, ok := seen[path]
+			if !ok || w.size != info.Size() || !w.modTime.Equal(info.ModTime()) {
+				seen[path] = &watchedFile{size: info.Size(), modTime: info.ModTime(), stableSince: now}
+				if stableFor > 0 {
+					return nil
+				}
+				w = seen[path]
+			}
+			if now.Sub(w.stableSince) < stableFor {
+				return nil
+			}
+
+			delete(seen, path)
+			queue.add(path, *w)
+			logger.LogInfo("New file ready for upload", map[string]interface{}{"file": path})
+			select {
+			case filesChan <- mediaFromFolder(c, path):
+				return nil
+			case <-ctx.Done():
+				return filepath.SkipAll
+			}
+		})
+		if err != nil {
+			logger.LogError("Error walking the path", map[string]interface{}{"Path": c.FolderConfig.Path, "error": err})
+		}
+
+		// forget files that were removed or moved away
+		for path := range seen {
+			if !present[path] {
+				delete(seen, path)
+			}
+		}
+		queue.keep(present)
+
+		select {
+		case <-ctx.Done():
+			close(filesChan)
+			return
+		case <-time.After(pollInterval):
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package media
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchQueue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "movie.mp4")
+	if err := os.WriteFile(path, []byte("video"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	queue := newWatchQueue()
+	queue.add(path, watchedFile{size: info.Size(), modTime: info.ModTime()})
+	if !queue.has(path, info, now) {
+		t.Fatal("queued file is not in the queue")
+	}
+
+	// a failed upload waits before it is queued again
+	queue.failed(path, now)
+	if !queue.has(path, info, now.Add(30*time.Second)) {
+		t.Error("failed file is retried before its delay")
+	}
+	if queue.has(path, info, now.Add(time.Minute)) {
+		t.Fatal("failed file isn't retried after its delay")
+	}
+
+	// after maxWatchAttempts failures the file stays queued while unchanged
+	for i := 1; i < maxWatchAttempts; i++ {
+		queue.add(path, watchedFile{size: info.Size(), modTime: info.ModTime()})
+		queue.failed(path, now)
+	}
+	if !queue.has(path, info, now.Add(24*time.Hour)) {
+		t.Error("file is retried after its last attempt")
+	}
+
+	// a changed file is queued again with its attempts reset
+	queue.add(path, watchedFile{size: info.Size(), modTime: info.ModTime().Add(-time.Minute)})
+	if queue.has(path, info, now) {
+		t.Error("changed file counts as queued")
+	}
+	if queue.files[path].attempts != 0 {
+		t.Error("changed file keeps the attempts of the earlier one")
+	}
+
+	queue.keep(map[string]bool{})
+	if len(queue.files) != 0 {
+		t.Error("removed files are kept in the queue")
+	}
+}
+
+func TestWatchRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{4, 8 * time.Minute},
+		{10, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := watchRetryDelay(tt.attempts); got != tt.want {
+			t.Errorf("watchRetryDelay(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package medialog
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"peertubeupload/config"
+	"peertubeupload/model"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Index holds what earlier runs uploaded, read back from the log, so the
+// same media isn't uploaded twice. A nil *Index finds nothing.
+type Index struct {
+	mutex  sync.Mutex
+	byKey  map[string]model.VideoClass
+	byHash map[string]model.VideoClass
+	// hashes is the content hash each key was uploaded with
+	hashes map[string]string
+}
+
+func newIndex() *Index {
+	return &Index{
+		byKey:  map[string]model.VideoClass{},
+		byHash: map[string]model.VideoClass{},
+		hashes: map[string]string{},
+	}
+}
+
+// Lookup finds an uploaded video by its key (file path or media identifiers)
+// or, when hash isn't empty, by content hash.
+func (i *Index) Lookup(key string, hash string) (model.VideoClass, bool) {
+	if i == nil {
+		return model.VideoClass{}, false
+	}
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	if video, ok := i.byKey[key]; ok {
+		return video, true
+	}
+	if hash != "" {
+		if video, ok := i.byHash[hash]; ok {
+			return video, true
+		}
+	}
+	return model.VideoClass{}, false
+}
+
+// Add records an upload made during this run.
+func (i *Index) Add(key string, hash string, video model.VideoClass) {
+	if i == nil || (video.UUID == "" && video.ID == 0) {
+		return
+	}
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	if key != "" {
+		i.byKey[key] = video
+	}
+	if hash != "" {
+		i.byHash[hash] = video
+	}
+	if key != "" && hash != "" {
+		i.hashes[key] = hash
+	}
+}
+
+// Changed finds the video uploaded under key from a file whose content hash
+// is not hash, a file that changed since its upload. Entries logged without
+// a hash never count as changed.
+func (i *Index) Changed(key string, hash string) (model.VideoClass, bool) {
+	if i == nil || key == "" || hash == "" {
+		return model.VideoClass{}, false
+	}
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	video, ok := i.byKey[key]
+	previous := i.hashes[key]
+	if !ok || previous == "" || previous == hash {
+		return model.VideoClass{}, false
+	}
+	return video, true
+}
+
+// Remove forgets a video, used when the instance no longer has it.
+func (i *Index) Remove(key string, hash string) {
+	if i == nil {
+		return
+	}
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	delete(i.byKey, key)
+	delete(i.byHash, hash)
+	delete(i.hashes, key)
+}
+
+// LoadFileIndex reads back the results LogResultToFile wrote, keyed with
+// Scope. Entries without a destination count for the first one. A missing
+// log file gives an empty index.
+func LoadFileIndex(path string, c *config.Config) (*Index, error) {
+	index := newIndex()
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var entry fileLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("not able to read %s line %d: %w", path, line, err)
+		}
+		if failed(entry.Video.Verification) {
+			continue
+		}
+		destination := entry.Destination
+		if destination == "" {
+			destination = defaultDestination(c)
+		}
+		index.Add(Scope(destination, entry.Media.FilePath), Scope(destination, entry.Media.Hash), entry.Video.Video)
+	}
+	return index, scanner.Err()
+}
+
+// LoadDBIndex reads back the log table LogResultToDB writes to, keyed by the
+// media identifier columns and the destination, see Scope.
+func LoadDBIndex(db *sql.DB, c *config.Config) (*Index, error) {
+	index := newIndex()
+
+	// a dry run doesn't migrate the table, so the columns a run adds may not
+	// be there yet and are left out
+	existing, err := tableColumns(db, LogTableName(c))
+	if err != nil {
+		return nil, fmt.Errorf("not able to read the columns of log table %s: %w", LogTableName(c), err)
+	}
+	for _, column := range c.DBConfig.MediaIdentifier {
+		if !existing[strings.ToLower(column)] {
+			return nil, fmt.Errorf("log table %s has no %s column, run once without --dry-run to migrate it", LogTableName(c), column)
+		}
+	}
+	var available []string
+	for _, column := range ReferenceColumns(c) {
+		switch strings.ToLower(column) {
+		case "peertube_id", "uuid", "shortuuid", "hash", DestinationColumn, StateColumn:
+			if existing[strings.ToLower(column)] {
+				available = append(available, strings.ToLower(column))
+			}
+		}
+	}
+	if !contains(available, "peertube_id") && !contains(available, "uuid") {
+		return nil, fmt.Errorf("log table %s needs a peertube_id or uuid reference column to find uploaded media", LogTableName(c))
+	}
+
+	columns := append(append([]string{}, c.DBConfig.MediaIdentifier...), available...)
+	rows, err := db.Query(fmt.Sprintf("SELECT %s FROM %s", strings.Join(columns, ","), LogTableName(c)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fallback := defaultDestination(c)
+	values := make([]sql.NullString, len(columns))
+	valuePtrs := make([]interface{}, len(columns))
+	for i := range values {
+		valuePtrs[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(valuePtrs...); err != nil {
+			return nil, err
+		}
+		row := map[string]interface{}{}
+		var video model.VideoClass
+		var hash, state string
+		destination := fallback
+		for i, column := range columns {
+			if i < len(c.DBConfig.MediaIdentifier) {
+				row[column] = values[i].String
+				continue
+			}
+			switch column {
+			case "peertube_id":
+				video.ID, _ = strconv.ParseInt(values[i].String, 10, 64)
+			case "uuid":
+				video.UUID = values[i].String
+			case "shortuuid":
+				video.ShortUUID = values[i].String
+			case "hash":
+				hash = values[i].String
+			case DestinationColumn:
+				if values[i].String != "" {
+					destination = values[i].String
+				}
+			case StateColumn:
+				state = values[i].String
+			}
+		}
+		if state == model.VerificationFailed {
+			continue
+		}
+		index.Add(Scope(destination, RowKey(c, row)), Scope(destination, hash), video)
+	}
+	return index, rows.Err()
+}
+
+// failed reports whether the video failed verification, such media is
+// uploaded again.
+func failed(v *model.Verification) bool {
+	return v != nil && v.State == model.VerificationFailed
+}
+
+// RowKey joins the media identifier values of a row into one lookup key.
+func RowKey(c *config.Config, row map[string]interface{}) string {
+	parts := make([]string, len(c.DBConfig.MediaIdentifier))
+	for i, column := range c.DBConfig.MediaIdentifier {
+		switch v := row[column].(type) {
+		case nil:
+		case []byte:
+			parts[i] = string(v)
+		default:
+			parts[i] = fmt.Sprintf("%v", v)
+		}
+	}
+	return strings.Join(parts, "|")
+}
+
+// tableColumns returns the lowercased column names of table. The query
+// selects no rows, it works the same on PostgreSQL and Oracle.
+func tableColumns(db *sql.DB, table string) (map[string]bool, error) {
+	rows, err := db.Query(fmt.Sprintf("SELECT * FROM %s WHERE 1 = 0", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	names, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	columns := map[string]bool{}
+	for _, name := range names {
+		columns[strings.ToLower(name)] = true
+	}
+	return columns, rows.Err()
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
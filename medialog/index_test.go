@@ -0,0 +1,82 @@
+package medialog
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"peertubeupload/config"
+	"peertubeupload/model"
+	"testing"
+)
+
+func TestIndexChanged(t *testing.T) {
+	index := newIndex()
+	video := model.VideoClass{ID: 1, UUID: "uploaded"}
+	index.Add("default|movie.mp4", "default|old", video)
+	index.Add("default|clip.mp4", "", model.VideoClass{ID: 2, UUID: "no-hash"})
+
+	tests := []struct {
+		name string
+		key  string
+		hash string
+		want bool
+	}{
+		{"same hash", "default|movie.mp4", "default|old", false},
+		{"new hash", "default|movie.mp4", "default|new", true},
+		{"no hash to compare", "default|movie.mp4", "", false},
+		{"logged without a hash", "default|clip.mp4", "default|new", false},
+		{"never uploaded", "default|other.mp4", "default|new", false},
+		{"other destination", "mirror|movie.mp4", "mirror|new", false},
+	}
+	for _, tt := range tests {
+		got, changed := index.Changed(tt.key, tt.hash)
+		if changed != tt.want {
+			t.Errorf("%s: Changed(%q, %q) = %v, want %v", tt.name, tt.key, tt.hash, changed, tt.want)
+		}
+		if changed && got != video {
+			t.Errorf("%s: Changed returned %+v, want %+v", tt.name, got, video)
+		}
+	}
+
+	var none *Index
+	if _, changed := none.Changed("default|movie.mp4", "default|new"); changed {
+		t.Error("a nil index reported a change")
+	}
+}
+
+func TestLoadFileIndexPerDestination(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log.json")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder := json.NewEncoder(file)
+	for _, entry := range []fileLogEntry{
+		{Media: model.Media{FilePath: "movie.mp4", Hash: "old"}, Video: model.Video{Video: model.VideoClass{ID: 1, UUID: "main-video"}}, Destination: "main"},
+		{Media: model.Media{FilePath: "movie.mp4", Hash: "old"}, Video: model.Video{Video: model.VideoClass{ID: 7, UUID: "mirror-video"}}, Destination: "mirror"},
+		// the replacement on main is logged after the upload, and wins
+		{Media: model.Media{FilePath: "movie.mp4", Hash: "new"}, Video: model.Video{Video: model.VideoClass{ID: 1, UUID: "main-video"}}, Destination: "main"},
+	} {
+		if err := encoder.Encode(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file.Close()
+
+	index, err := LoadFileIndex(path, &config.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if video, ok := index.Lookup(Scope("mirror", "movie.mp4"), ""); !ok || video.UUID != "mirror-video" {
+		t.Errorf("Lookup on mirror = %+v, %v, want mirror-video", video, ok)
+	}
+	if _, ok := index.Lookup(Scope("backup", "movie.mp4"), Scope("backup", "new")); ok {
+		t.Error("media uploaded to main and mirror counts as uploaded to backup")
+	}
+	if _, changed := index.Changed(Scope("main", "movie.mp4"), Scope("main", "new")); changed {
+		t.Error("main already has the new file, want it unchanged")
+	}
+	if video, changed := index.Changed(Scope("mirror", "movie.mp4"), Scope("mirror", "new")); !changed || video.UUID != "mirror-video" {
+		t.Errorf("Changed on mirror = %+v, %v, want mirror-video to be replaced", video, changed)
+	}
+}
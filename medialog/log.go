@@ -10,21 +10,95 @@ import (
 	"strings"
 )
 
-func LogResultToFile(media model.Video, f model.Media, c *config.Config) error {
+// LogFile is where LogResultToFile appends results, one JSON object per line.
+const LogFile = "log.json"
+
+type fileLogEntry struct {
+	Media       model.Media
+	Video       model.Video
+	Destination string
+}
+
+// DestinationColumn holds the destination name in the log table when
+// destinations are configured.
+const DestinationColumn = "destination"
+
+// Columns verificationConfig adds to the log table.
+const (
+	StateColumn       = "state"
+	DurationColumn    = "duration"
+	ResolutionsColumn = "resolutions"
+)
+
+// LogTableName is the table LogResultToDB writes to.
+func LogTableName(c *config.Config) string {
+	if c.LoadType.LoadPathFromDB {
+		return fmt.Sprintf("%s_to_peertube_log", c.DBConfig.TableName)
+	}
+	return "peertube_log"
+}
+
+// ReferenceColumns are the dbConfig reference columns plus the ones other
+// options need in the log table.
+func ReferenceColumns(c *config.Config) []string {
+	columns := append([]string{}, c.DBConfig.ReferenceColumns...)
+	if c.LoadType.MatchByHash && !containsFold(columns, "hash") {
+		columns = append(columns, "hash")
+	}
+	if len(c.Destinations) > 0 && !containsFold(columns, DestinationColumn) {
+		columns = append(columns, DestinationColumn)
+	}
+	if c.VerificationConfig.Enabled {
+		for _, column := range []string{StateColumn, DurationColumn, ResolutionsColumn} {
+			if !containsFold(columns, column) {
+				columns = append(columns, column)
+			}
+		}
+	}
+	return columns
+}
+
+// Scope ties a log key or hash to a destination, media uploaded to one
+// destination still has to go to the others.
+func Scope(destination string, value string) string {
+	if value == "" {
+		return ""
+	}
+	return destination + "|" + value
+}
+
+// defaultDestination is the destination log entries written without one
+// belong to, the first configured one.
+func defaultDestination(c *config.Config) string {
+	destinations, err := c.UploadDestinations()
+	if err != nil || len(destinations) == 0 {
+		return config.DefaultDestination
+	}
+	return destinations[0].Name
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func LogResultToFile(media model.Video, f model.Media, c *config.Config, destination string) error {
 
 	// Open the file in append mode
-	file, err := os.OpenFile("log.json", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	file, err := os.OpenFile(LogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
 	if err != nil {
 		return err
 	}
 	encoder := json.NewEncoder(file)
 	defer file.Close()
-	combined := struct {
-		Media model.Media
-		Video model.Video
-	}{
-		Media: f,
-		Video: media,
+	combined := fileLogEntry{
+		Media:       f,
+		Video:       media,
+		Destination: destination,
 	}
 
 	err = encoder.Encode(combined)
@@ -35,19 +109,15 @@ func LogResultToFile(media model.Video, f model.Media, c *config.Config) error {
 	return nil
 }
 func LogResultToDB(media model.Video, f map[string]interface{}, c *config.Config, db *sql.DB, fPath string) error {
-	var logTableName string
-	if c.LoadType.LoadPathFromDB {
-		logTableName = fmt.Sprintf("%s_to_peertube_log", c.DBConfig.TableName)
-	} else {
-		logTableName = "peertube_log"
-	}
+	logTableName := LogTableName(c)
 
-	combinedColumns := append(c.DBConfig.ReferenceColumns, c.DBConfig.MediaIdentifier...)
+	combinedColumns := append(ReferenceColumns(c), c.DBConfig.MediaIdentifier...)
 
 	shit, err := mergeStructAndMap(media.Video, f)
 	if err != nil {
 		return err
 	}
+	addVerification(c, media, shit)
 	// Create a slice to hold the values to be inserted
 	values := make([]interface{}, len(combinedColumns))
 	for i, column := range combinedColumns {
@@ -94,6 +164,72 @@ func LogResultToDB(media model.Video, f map[string]interface{}, c *config.Config
 	return nil
 }
 
+// UpdateReplacedInDB updates the log row of a video whose file was replaced
+// with the hash of the new file and, with verificationConfig, its new state.
+// The row is found by peertube_id, or uuid, and destination.
+func UpdateReplacedInDB(media model.Video, f map[string]interface{}, c *config.Config, db *sql.DB) error {
+	merged, err := mergeStructAndMap(media.Video, f)
+	if err != nil {
+		return err
+	}
+	addVerification(c, media, merged)
+
+	var set, where []string
+	var values []interface{}
+	for _, column := range ReferenceColumns(c) {
+		switch strings.ToLower(column) {
+		case "hash", StateColumn, DurationColumn, ResolutionsColumn:
+			values = append(values, merged[strings.ToLower(column)])
+			set = append(set, fmt.Sprintf("%s = %s", column, placeholder(c, len(values))))
+		}
+	}
+	if len(set) == 0 {
+		return nil
+	}
+
+	idColumn := "peertube_id"
+	if !containsFold(ReferenceColumns(c), idColumn) {
+		idColumn = "uuid"
+	}
+	for _, column := range []string{idColumn, DestinationColumn} {
+		if !containsFold(ReferenceColumns(c), column) {
+			continue
+		}
+		values = append(values, merged[column])
+		where = append(where, fmt.Sprintf("%s = %s", column, placeholder(c, len(values))))
+	}
+	if len(where) == 0 {
+		return fmt.Errorf("log table %s needs a peertube_id or uuid reference column to update the replaced video", LogTableName(c))
+	}
+
+	_, err = db.Exec(fmt.Sprintf("UPDATE %s SET %s WHERE %s",
+		LogTableName(c),
+		strings.Join(set, ", "),
+		strings.Join(where, " AND "),
+	), values...)
+	return err
+}
+
+// addVerification sets the verificationConfig columns of a log row, a
+// video whose state couldn't be checked gets nulls.
+func addVerification(c *config.Config, media model.Video, row map[string]interface{}) {
+	if !c.VerificationConfig.Enabled {
+		return
+	}
+	row[StateColumn], row[DurationColumn], row[ResolutionsColumn] = nil, nil, nil
+	if v := media.Verification; v != nil {
+		row[StateColumn], row[DurationColumn], row[ResolutionsColumn] = v.State, v.Duration, strings.Join(v.Resolutions, ",")
+	}
+}
+
+// placeholder is the n-th bind parameter in the syntax of dbConfig.dbType.
+func placeholder(c *config.Config, n int) string {
+	if c.DBConfig.DBType == "oracle" {
+		return fmt.Sprintf(":%d", n)
+	}
+	return fmt.Sprintf("$%d", n)
+}
+
 func mergeStructAndMap(s model.VideoClass, m map[string]interface{}) (map[string]interface{}, error) {
 
 	ptid := struct {
@@ -50,7 +50,28 @@ func (r *Video) Marshal() ([]byte, error) {
 
 type Video struct {
 	Video VideoClass `json:"video"`
-}
+	// Verification is what the instance reported after the upload, nil when
+	// verificationConfig is off
+	Verification *Verification `json:"verification,omitempty"`
+}
+
+// Verification is the state a video reached after its upload, see
+// verificationConfig.
+type Verification struct {
+	// State is published, failed or timeout
+	State string `json:"state"`
+	// Label is the state as PeerTube names it
+	Label       string   `json:"label"`
+	Duration    int      `json:"duration"`
+	Resolutions []string `json:"resolutions"`
+}
+
+// Verification states. A failed video is uploaded again by the next run.
+const (
+	VerificationPublished = "published"
+	VerificationFailed    = "failed"
+	VerificationTimeout   = "timeout"
+)
 
 type VideoClass struct {
 	ID        int64  `json:"id"`
@@ -63,6 +84,47 @@ type Media struct {
 	Description string
 	FilePath    string
 	CreateDate  time.Time
+	Tags        []string
+	Category    int
+	Licence     int
+	Language    string
+	NSFW        bool
+	Support     string
+	// Privacy overrides apiConfig.privacy when it is not 0
+	Privacy       int
+	ThumbnailPath string
+	Captions      []Caption
+	// Hash is the sha256 of the file, set when loadType.matchByHash is on
+	Hash string
+	// ConvertedPath is the temporary mp3 uploaded instead of FilePath with
+	// loadType.convertAudioToMp3
+	ConvertedPath string `json:"-"`
+	// DateCandidates holds the dates found in the db row or sidecar by source,
+	// CreateDate is picked from them following loadType.dateSources
+	DateCandidates map[string]time.Time `json:"-"`
+	// Channel is the channel name, handle or id picked by channel routing,
+	// empty for the channelId of the destination
+	Channel string
+	// ChannelRouted is set when Channel comes from a rule or subfolder, it is
+	// then matched by name only, never taken as an id
+	ChannelRouted bool
+	// Destinations limits the upload to the destinations with these names,
+	// all destinations when empty
+	Destinations []string
+	// Playlist is the name or id of the playlist the video is added to, empty
+	// for none
+	Playlist string
+	// PlaylistRouted is set when Playlist is the name of the folder of the
+	// file, it is then matched by name only, never taken as an id
+	PlaylistRouted bool
+	// PlaylistPosition orders the video in its playlist when
+	// playlistConfig.order is position, 0 if unknown
+	PlaylistPosition int
+}
+
+type Caption struct {
+	Language string
+	Path     string
 }
 
 func UnmarshalMetadata(data []byte) (Metadata, error) {
@@ -99,6 +161,8 @@ type FormatTags struct {
 	MinorVersion     string `json:"minor_version"`
 	CompatibleBrands string `json:"compatible_brands"`
 	CreationTime     string `json:"creation_time"`
+	// QuickTimeCreationDate is the capture date cameras and phones write
+	QuickTimeCreationDate string `json:"com.apple.quicktime.creationdate"`
 }
 
 type Stream struct {
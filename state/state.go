@@ -0,0 +1,218 @@
+package state
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// sampleSize is how much of the head and tail of a file goes into its hash.
+// Hashing whole multi-gigabyte files on every run would cost more than the
+// resume saves, and size+mtime already catch most changes.
+const sampleSize = 4 * 1024 * 1024
+
+// Session is a resumable upload that was started but not finished.
+type Session struct {
+	Hostname  string    `json:"hostname"`
+	FilePath  string    `json:"filePath"`
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"modTime"`
+	Hash      string    `json:"hash"`
+	UploadURL string    `json:"uploadUrl"`
+	// LastByte is the last byte the server acknowledged, -1 if none yet.
+	LastByte  int64     `json:"lastByte"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// HandledFile is a file the watch mode already uploaded, remembered by size
+// and mtime so a changed file is picked up again.
+type HandledFile struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// Store keeps resumable sessions and the files the watch mode handled in a
+// JSON file so they survive a restart. A nil *Store is valid and simply remembers nothing.
+type Store struct {
+	path     string
+	mutex    sync.Mutex
+	Sessions map[string]Session     `json:"sessions"`
+	Handled  map[string]HandledFile `json:"handled"`
+}
+
+// Open loads the store at path, creating an empty one if the file does not
+// exist yet. An empty path disables persistence and returns a nil store.
+func Open(path string) (*Store, error) {
+	if path == "" {
+		return nil, nil
+	}
+	s := &Store{path: path, Sessions: map[string]Session{}, Handled: map[string]HandledFile{}}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return s, nil
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("not able to read state file %s: %w", path, err)
+	}
+	if s.Sessions == nil {
+		s.Sessions = map[string]Session{}
+	}
+	if s.Handled == nil {
+		s.Handled = map[string]HandledFile{}
+	}
+	return s, nil
+}
+
+// Key identifies the session of filePath on one destination, two accounts of
+// the same instance upload the same file in sessions of their own.
+func Key(destination string, hostname string, filePath string) string {
+	return destination + "|" + hostname + "|" + filePath
+}
+
+func (s *Store) Get(key string) (Session, bool) {
+	if s == nil {
+		return Session{}, false
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	session, ok := s.Sessions[key]
+	return session, ok
+}
+
+func (s *Store) Put(key string, session Session) error {
+	if s == nil {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	session.UpdatedAt = time.Now()
+	s.Sessions[key] = session
+	return s.save()
+}
+
+func (s *Store) Delete(key string) error {
+	if s == nil {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.Sessions[key]; !ok {
+		return nil
+	}
+	delete(s.Sessions, key)
+	return s.save()
+}
+
+// MarkHandled remembers filePath as uploaded in its current size and mtime.
+func (s *Store) MarkHandled(filePath string) error {
+	if s == nil {
+		return nil
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.Handled[filePath] = HandledFile{Size: info.Size(), ModTime: info.ModTime()}
+	return s.save()
+}
+
+// IsHandled reports whether filePath was uploaded and hasn't changed since.
+func (s *Store) IsHandled(filePath string, info os.FileInfo) bool {
+	if s == nil {
+		return false
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	handled, ok := s.Handled[filePath]
+	return ok && handled.Size == info.Size() && handled.ModTime.Equal(info.ModTime())
+}
+
+// save writes to a temp file and renames it so a crash mid-write never
+// leaves a truncated state file behind. Callers must hold the mutex.
+func (s *Store) save() error {
+	data, err := json.MarshalIndent(s, "", " ")
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(s.path); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// Identify fills in the file identity fields of a session for filePath.
+func Identify(filePath string) (Session, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return Session{}, err
+	}
+	hash, err := sampleHash(filePath, info.Size())
+	if err != nil {
+		return Session{}, err
+	}
+	return Session{
+		FilePath: filePath,
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+		Hash:     hash,
+		LastByte: -1,
+	}, nil
+}
+
+// SameFile reports whether two sessions describe the same, unchanged file.
+func (s Session) SameFile(other Session) bool {
+	return s.FilePath == other.FilePath &&
+		s.Size == other.Size &&
+		s.ModTime.Equal(other.ModTime) &&
+		s.Hash == other.Hash
+}
+
+func sampleHash(filePath string, size int64) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%d:", size)
+	if size <= 2*sampleSize {
+		if _, err := io.Copy(h, f); err != nil {
+			return "", err
+		}
+	} else {
+		if _, err := io.Copy(h, io.NewSectionReader(f, 0, sampleSize)); err != nil {
+			return "", err
+		}
+		if _, err := io.Copy(h, io.NewSectionReader(f, size-sampleSize, sampleSize)); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}